@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// checkTarget returns the gRPC dial target of the shim's own listener.
+func checkTarget(network, socketPath, addr string) (string, error) {
+	switch network {
+	case "unix":
+		if isAbstractSocket(socketPath) {
+			return "unix-abstract:" + strings.TrimPrefix(socketPath, "@"), nil
+		}
+		return "unix://" + socketPath, nil
+	case "tcp":
+		return "dns:///" + addr, nil
+	case "npipe":
+		// The pipe path is handed to the dialer of pipeDialOption as is.
+		return "passthrough:///" + addr, nil
+	default:
+		return "", fmt.Errorf("unsupported listen network %q: must be unix, tcp or npipe", network)
+	}
+}
+
+// runCheck connects to a running shim as a Workload API client and fetches a
+// single X.509 SVID response, returning the SPIFFE ID of its first SVID. The
+// workload header is sent unless header is empty, mirroring what the server's
+// interceptors require. opts are added to the client's dial options.
+func runCheck(target, header string, timeout time.Duration, opts ...grpc.DialOption) (string, error) {
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return "", fmt.Errorf("create client: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if header != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, header, "true")
+	}
+	stream, err := workloadv1.NewSpiffeWorkloadAPIClient(conn).FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		return "", fmt.Errorf("FetchX509SVID: %w", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return "", fmt.Errorf("FetchX509SVID: %w", err)
+	}
+	if len(resp.Svids) == 0 || resp.Svids[0].SpiffeId == "" {
+		return "", errors.New("FetchX509SVID returned no SPIFFE ID")
+	}
+	return resp.Svids[0].SpiffeId, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/larkintuckerllc/workload-api-shim/internal/shimserver"
+)
+
+// reloadableFlags are the flags whose --config values are applied on SIGHUP.
+// Every other flag only takes effect at startup.
+var reloadableFlags = []string{"log-level", "debounce", "bundle-allow"}
+
+// readConfig reads a --config file: a JSON object mapping flag names, without
+// the leading dashes, to values. A value is a string, number or boolean, or,
+// for repeatable flags, an array of them.
+func readConfig(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	values := make(map[string][]string, len(raw))
+	for name, msg := range raw {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(msg, &elems); err != nil {
+			elems = []json.RawMessage{msg}
+		}
+		for _, elem := range elems {
+			v, err := configValue(elem)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+			values[name] = append(values[name], v)
+		}
+	}
+	return values, nil
+}
+
+// configValue returns the flag value of a JSON string, number or boolean.
+func configValue(msg json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(msg, &s); err == nil {
+		return s, nil
+	}
+	var b bool
+	if err := json.Unmarshal(msg, &b); err == nil {
+		return strconv.FormatBool(b), nil
+	}
+	var n json.Number
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	if err := dec.Decode(&n); err == nil {
+		return n.String(), nil
+	}
+	return "", fmt.Errorf("unsupported value %s", msg)
+}
+
+// checkConfig returns an error for a name in values that is not a flag of
+// fs, and for more than one value for a flag that is not repeatable.
+func checkConfig(fs *flag.FlagSet, values map[string][]string) error {
+	for name, vs := range values {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if _, repeated := f.Value.(*stringList); !repeated && len(vs) != 1 {
+			return fmt.Errorf("flag %q takes a single value", name)
+		}
+	}
+	return nil
+}
+
+// applyConfig sets every flag of fs that is not in fixed from values.
+func applyConfig(fs *flag.FlagSet, values map[string][]string, fixed map[string]bool) error {
+	if err := checkConfig(fs, values); err != nil {
+		return err
+	}
+	for name, vs := range values {
+		if fixed[name] {
+			continue
+		}
+		for _, v := range vs {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configReloader re-reads the --config file and applies the reloadable flags
+// to a running shim.
+type configReloader struct {
+	path     string
+	fs       *flag.FlagSet
+	fixed    map[string]bool // flags set on the command line or in the environment
+	applied  map[string][]string
+	level    *slog.LevelVar
+	shim     *shimserver.ShimServer
+	settings shimserver.Settings
+}
+
+// value returns the value of a reloadable flag under values: the one given
+// in values, or the flag's default when values has none.
+func (r *configReloader) value(values map[string][]string, name string) string {
+	if vs, ok := values[name]; ok {
+		return vs[0]
+	}
+	return r.fs.Lookup(name).DefValue
+}
+
+// reload re-reads the config file. Reloadable flags that are not fixed are
+// applied to the shim together; a change to any other flag is logged as
+// needing a restart. Nothing is applied when the file or a value is invalid.
+func (r *configReloader) reload() error {
+	values, err := readConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if err := checkConfig(r.fs, values); err != nil {
+		return err
+	}
+
+	st := r.settings
+	var level slog.Level
+	if !r.fixed["log-level"] {
+		if err := level.UnmarshalText([]byte(r.value(values, "log-level"))); err != nil {
+			return fmt.Errorf("log-level: %w", err)
+		}
+	}
+	if !r.fixed["debounce"] {
+		if st.Debounce, err = time.ParseDuration(r.value(values, "debounce")); err != nil {
+			return fmt.Errorf("debounce: %w", err)
+		}
+	}
+	if !r.fixed["bundle-allow"] {
+		if st.BundleAllow, err = parseBundleAllow(r.value(values, "bundle-allow")); err != nil {
+			return fmt.Errorf("bundle-allow: %w", err)
+		}
+	}
+
+	for name := range mergedKeys(r.applied, values) {
+		if slices.Contains(reloadableFlags, name) || r.fixed[name] {
+			continue
+		}
+		if !slices.Equal(r.applied[name], values[name]) {
+			slog.Warn("config change needs a restart to take effect", "flag", name)
+		}
+	}
+	if !r.fixed["log-level"] {
+		r.level.Set(level)
+	}
+	r.shim.Reload(st)
+	r.settings = st
+	r.applied = values
+	return nil
+}
+
+// mergedKeys returns the union of the keys of a and b.
+func mergedKeys(a, b map[string][]string) map[string]bool {
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
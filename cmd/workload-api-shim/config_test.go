@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/larkintuckerllc/workload-api-shim/internal/shimserver"
+)
+
+// testShim returns a ShimServer serving an in-memory leaf for
+// spiffe://example.org/workload issued by a new self-signed CA.
+func testShim(t *testing.T) *shimserver.ShimServer {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		URIs:         []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/workload"}},
+	}, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shim, err := shimserver.New(shimserver.Config{Files: map[string][]byte{
+		"certificates.pem":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		"private_key.pem":     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		"ca_certificates.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		"trust_bundles.json":  []byte(`{"trust_domains": {}}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(shim.Close)
+	return shim
+}
+
+// captureLogs sends the default logger to a buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestConfigReload(t *testing.T) {
+	// Every case starts from a config file that set these values.
+	applied := map[string][]string{
+		"log-level":    {"warn"},
+		"debounce":     {"1s"},
+		"bundle-allow": {"other.org"},
+		"log-format":   {"text"},
+	}
+	initial := shimserver.Settings{Debounce: time.Second, BundleAllow: []string{"other.org"}}
+
+	for _, tc := range []struct {
+		name      string
+		config    string
+		fixed     []string
+		wantErr   string
+		wantLevel slog.Level
+		want      shimserver.Settings
+		wantWarn  string // the flag logged as needing a restart, if any
+	}{
+		{
+			name:      "file values applied",
+			config:    `{"log-level": "debug", "debounce": "2s", "bundle-allow": "a.org,b.org", "log-format": "text"}`,
+			wantLevel: slog.LevelDebug,
+			want:      shimserver.Settings{Debounce: 2 * time.Second, BundleAllow: []string{"a.org", "b.org"}},
+		},
+		{
+			name:      "fixed flags win over the file",
+			config:    `{"log-level": "debug", "debounce": "2s", "bundle-allow": "a.org", "log-format": "text"}`,
+			fixed:     []string{"log-level", "debounce"},
+			wantLevel: slog.LevelWarn,
+			want:      shimserver.Settings{Debounce: time.Second, BundleAllow: []string{"a.org"}},
+		},
+		{
+			name:      "removed keys reset to the default",
+			config:    `{"debounce": "2s", "log-format": "text"}`,
+			wantLevel: slog.LevelInfo,
+			want:      shimserver.Settings{Debounce: 2 * time.Second},
+		},
+		{
+			name:      "invalid value applies nothing",
+			config:    `{"log-level": "debug", "debounce": "soon", "log-format": "text"}`,
+			wantErr:   "debounce",
+			wantLevel: slog.LevelWarn,
+			want:      initial,
+		},
+		{
+			name:      "invalid bundle-allow applies nothing",
+			config:    `{"log-level": "debug", "bundle-allow": "a.org,not a domain", "log-format": "text"}`,
+			wantErr:   "bundle-allow",
+			wantLevel: slog.LevelWarn,
+			want:      initial,
+		},
+		{
+			name:      "unknown flag applies nothing",
+			config:    `{"log-level": "debug", "no-such-flag": true}`,
+			wantErr:   "unknown flag",
+			wantLevel: slog.LevelWarn,
+			want:      initial,
+		},
+		{
+			name:      "non-reloadable change needs a restart",
+			config:    `{"log-level": "warn", "debounce": "1s", "bundle-allow": "other.org", "log-format": "json"}`,
+			wantLevel: slog.LevelWarn,
+			want:      initial,
+			wantWarn:  "log-format",
+		},
+		{
+			name:      "non-reloadable key removed needs a restart",
+			config:    `{"log-level": "warn", "debounce": "1s", "bundle-allow": "other.org"}`,
+			wantLevel: slog.LevelWarn,
+			want:      initial,
+			wantWarn:  "log-format",
+		},
+		{
+			name:      "fixed non-reloadable change is not logged",
+			config:    `{"log-level": "warn", "debounce": "1s", "bundle-allow": "other.org", "log-format": "json"}`,
+			fixed:     []string{"log-format"},
+			wantLevel: slog.LevelWarn,
+			want:      initial,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("log-level", "info", "")
+			fs.Duration("debounce", 100*time.Millisecond, "")
+			fs.String("bundle-allow", "", "")
+			fs.String("log-format", "text", "")
+
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			fixed := make(map[string]bool)
+			for _, name := range tc.fixed {
+				fixed[name] = true
+			}
+			level := new(slog.LevelVar)
+			level.Set(slog.LevelWarn)
+			r := &configReloader{
+				path:     path,
+				fs:       fs,
+				fixed:    fixed,
+				applied:  applied,
+				level:    level,
+				shim:     testShim(t),
+				settings: initial,
+			}
+			logs := captureLogs(t)
+
+			err := r.reload()
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("reload error = %v, want one naming %s", err, tc.wantErr)
+				}
+				if r.applied["log-level"][0] != "warn" {
+					t.Error("a failed reload replaced the applied config values")
+				}
+			}
+			if got := level.Level(); got != tc.wantLevel {
+				t.Errorf("log level = %v, want %v", got, tc.wantLevel)
+			}
+			if r.settings.Debounce != tc.want.Debounce || !slices.Equal(r.settings.BundleAllow, tc.want.BundleAllow) {
+				t.Errorf("settings = %+v, want %+v", r.settings, tc.want)
+			}
+			restart := strings.Contains(logs.String(), "needs a restart")
+			switch {
+			case tc.wantWarn == "" && restart:
+				t.Errorf("unexpected restart warning:\n%s", logs)
+			case tc.wantWarn != "" && !strings.Contains(logs.String(), "needs a restart to take effect\" flag="+tc.wantWarn):
+				t.Errorf("no restart warning for %s:\n%s", tc.wantWarn, logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the environment variable of every flag.
+const envPrefix = "SHIM_"
+
+// flagEnvVar returns the environment variable read for the named flag, e.g.
+// SHIM_SOCKET_PATH for --socket-path.
+func flagEnvVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag of fs that was not given on the command line from
+// its environment variable, if that is set, so flags take precedence over the
+// environment. Repeatable flags take a comma-separated list.
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvVar(f.Name))
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, repeated := f.Value.(*stringList); repeated {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("%s: %w", flagEnvVar(f.Name), serr)
+				return
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		wantErr      string
+		wantDebounce time.Duration
+		wantDirs     []string
+	}{
+		{
+			name:         "unset flag taken from the environment",
+			env:          map[string]string{"SHIM_DEBOUNCE": "2s"},
+			wantDebounce: 2 * time.Second,
+		},
+		{
+			name:         "flag on the command line wins",
+			args:         []string{"--debounce=3s", "--creds-dir=/flag"},
+			env:          map[string]string{"SHIM_DEBOUNCE": "2s", "SHIM_CREDS_DIR": "/env"},
+			wantDebounce: 3 * time.Second,
+			wantDirs:     []string{"/flag"},
+		},
+		{
+			name:         "repeatable flag split on commas",
+			env:          map[string]string{"SHIM_CREDS_DIR": "/a,/b,/c"},
+			wantDebounce: 100 * time.Millisecond,
+			wantDirs:     []string{"/a", "/b", "/c"},
+		},
+		{
+			name:    "bad value names the variable",
+			env:     map[string]string{"SHIM_DEBOUNCE": "soon"},
+			wantErr: "SHIM_DEBOUNCE",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			debounce := fs.Duration("debounce", 100*time.Millisecond, "")
+			var credsDirs stringList
+			fs.Var(&credsDirs, "creds-dir", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			err := applyEnv(fs)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr+":") {
+					t.Fatalf("applyEnv error = %v, want one naming %s", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnv: %v", err)
+			}
+			if *debounce != tc.wantDebounce {
+				t.Errorf("debounce = %v, want %v", *debounce, tc.wantDebounce)
+			}
+			if !slices.Equal(credsDirs, tc.wantDirs) {
+				t.Errorf("creds-dir = %q, want %q", credsDirs, tc.wantDirs)
+			}
+		})
+	}
+}
+
+func TestFlagEnvVar(t *testing.T) {
+	if got := flagEnvVar("socket-path"); got != "SHIM_SOCKET_PATH" {
+		t.Fatalf("flagEnvVar(socket-path) = %q, want SHIM_SOCKET_PATH", got)
+	}
+}
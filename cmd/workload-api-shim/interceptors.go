@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// defaultWorkloadHeader is the metadata header the SPIFFE Workload Endpoint
+// spec requires on every call.
+const defaultWorkloadHeader = "workload.spiffe.io"
+
+// headerExempt reports whether fullMethod may be called without the workload
+// header. Health checks are exempt so that standard probes such as
+// grpc_health_probe work against the socket.
+func headerExempt(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
+
+func workloadHeaderUnaryInterceptor(header string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if headerExempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok || len(md.Get(header)) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "missing required header: %s", header)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func workloadHeaderStreamInterceptor(header string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if headerExempt(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		md, ok := metadata.FromIncomingContext(ss.Context())
+		if !ok || len(md.Get(header)) == 0 {
+			return status.Errorf(codes.InvalidArgument, "missing required header: %s", header)
+		}
+		return handler(srv, ss)
+	}
+}
+
+// callerAttrs returns log attributes identifying the caller of ctx: the uid,
+// gid and pid of a unix socket peer when peerCredTransport recorded them, and
+// the peer address otherwise.
+func callerAttrs(ctx context.Context) []any {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if info, ok := p.AuthInfo.(peerCredAuthInfo); ok && info.pid != 0 {
+		return []any{"uid", info.uid, "gid", info.gid, "pid", info.pid}
+	}
+	if p.Addr != nil && p.Addr.String() != "" {
+		return []any{"peer", p.Addr.String()}
+	}
+	return nil
+}
+
+// callerLogUnaryInterceptor logs every Workload API call with the identity of
+// its caller, for auditing which workloads fetch credentials. Health checks
+// are not logged.
+func callerLogUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !headerExempt(info.FullMethod) {
+			slog.Info("workload API call", append([]any{"method", info.FullMethod}, callerAttrs(ctx)...)...)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func callerLogStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !headerExempt(info.FullMethod) {
+			slog.Info("workload API call", append([]any{"method", info.FullMethod}, callerAttrs(ss.Context())...)...)
+		}
+		return handler(srv, ss)
+	}
+}
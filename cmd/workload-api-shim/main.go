@@ -2,64 +2,796 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
-	"google.golang.org/grpc/status"
 
 	"github.com/larkintuckerllc/workload-api-shim/internal/shimserver"
 )
 
-const workloadHeader = "workload.spiffe.io"
+// isAbstractSocket reports whether socketPath names a Linux abstract
+// namespace socket, written with a leading "@".
+func isAbstractSocket(socketPath string) bool {
+	return strings.HasPrefix(socketPath, "@")
+}
+
+// listen creates the Workload API listener. For the unix network any stale
+// socket file left by a previous run is removed first; abstract sockets have
+// no file and are released by the kernel when the listener closes. For the
+// npipe network addr is the pipe path, and Windows removes the pipe when the
+// listener closes.
+func listen(network, socketPath, addr, pipeSDDL string) (net.Listener, error) {
+	switch network {
+	case "unix":
+		if isAbstractSocket(socketPath) {
+			if runtime.GOOS != "linux" {
+				return nil, fmt.Errorf("abstract unix socket %q is only supported on Linux", socketPath)
+			}
+			return net.Listen("unix", socketPath)
+		}
+		os.Remove(socketPath)
+		return net.Listen("unix", socketPath)
+	case "tcp":
+		return net.Listen("tcp", addr)
+	case "npipe":
+		return listenPipe(addr, pipeSDDL)
+	default:
+		return nil, fmt.Errorf("unsupported listen network %q: must be unix, tcp or npipe", network)
+	}
+}
+
+// workloadListener is one Workload API listener: a unix socket at socketPath,
+// a TCP listener on addr, or a Windows named pipe at the path addr.
+type workloadListener struct {
+	network    string
+	socketPath string
+	addr       string
+	socketMode string
+	socketGID  int
+	dirMode    os.FileMode // of the socket file's parent directories created by open
+	pipeSDDL   string
+	lis        net.Listener
+}
+
+// socketFile reports whether the listener has a socket file on disk, which
+// gets the socket permissions and is removed on shutdown.
+func (l *workloadListener) socketFile() bool {
+	return l.network == "unix" && !isAbstractSocket(l.socketPath)
+}
+
+// open creates the listener and applies the socket permissions, first
+// creating the directory of a socket file when it does not exist.
+func (l *workloadListener) open() (net.Listener, error) {
+	if l.socketFile() {
+		dir := filepath.Dir(l.socketPath)
+		if err := mkdirAllMode(dir, l.dirMode); err != nil {
+			return nil, fmt.Errorf("create socket directory %s: %w", dir, err)
+		}
+	}
+	lis, err := listen(l.network, l.socketPath, l.addr, l.pipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	if l.socketFile() {
+		if err := setSocketPermissions(l.socketPath, l.socketMode, l.socketGID); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("set socket permissions: %w", err)
+		}
+	}
+	return lis, nil
+}
+
+// String returns the listener address as network://address.
+func (l *workloadListener) String() string {
+	return l.network + "://" + l.lis.Addr().String()
+}
+
+// mkdirAllMode creates dir and any missing parents like os.MkdirAll, then sets
+// mode on each directory it created, so that the umask does not narrow it.
+// Directories that already existed are left unchanged.
+func mkdirAllMode(dir string, mode os.FileMode) error {
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSocketPermissions applies mode (octal, e.g. "0660") and gid to the socket
+// file. An empty mode or a negative gid leaves that attribute unchanged.
+func setSocketPermissions(socketPath, mode string, gid int) error {
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("parse socket mode %q: %w", mode, err)
+		}
+		if err := os.Chmod(socketPath, os.FileMode(m)); err != nil {
+			return fmt.Errorf("chmod socket: %w", err)
+		}
+	}
+	if gid >= 0 {
+		if err := os.Chown(socketPath, -1, gid); err != nil {
+			return fmt.Errorf("chown socket: %w", err)
+		}
+	}
+	return nil
+}
+
+// newLogger builds a logger writing to stderr at the given level
+// (debug, info, warn, error) in the given format (text, json). The level can
+// be changed later through the returned LevelVar.
+func newLogger(level, format string) (*slog.Logger, *slog.LevelVar, error) {
+	lvl := new(slog.LevelVar)
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), lvl, nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), lvl, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+}
+
+// fatal logs msg and args at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// startMetricsServer serves Prometheus metrics on addr at /metrics.
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	hs := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("metrics server error", "error", err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", "http://"+addr+"/metrics")
+	return hs
+}
+
+// startPprofServer serves the net/http/pprof profiling handlers on addr.
+func startPprofServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	hs := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("pprof server error", "error", err)
+		}
+	}()
+	slog.Info("serving pprof", "addr", "http://"+addr+"/debug/pprof/")
+	return hs
+}
+
+// debugStatus is the document served by the debug socket: the shim's Status
+// plus the Workload API listener, which only main knows.
+type debugStatus struct {
+	Listen  string `json:"listen"`
+	Version string `json:"version"`
+	shimserver.Status
+}
+
+// startDebugServer serves GET /status, the effective configuration and last
+// rebuild status as JSON, on the unix socket at path. The socket is created
+// with mode 0600 so that only the shim's user can query it.
+func startDebugServer(path, listenAddr string, shim *shimserver.ShimServer) (*http.Server, error) {
+	os.Remove(path)
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("chmod debug socket: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		v, _, _ := buildInfo()
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(debugStatus{Listen: listenAddr, Version: v, Status: shim.Status()})
+	})
+	hs := &http.Server{Handler: mux}
+	go func() {
+		if err := hs.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("debug server error", "error", err)
+		}
+	}()
+	slog.Info("serving debug status", "addr", "unix://"+path)
+	return hs, nil
+}
+
+// startBundleEndpoint serves the local trust domain's SPIFFE bundle over HTTPS on addr.
+func startBundleEndpoint(addr string, shim *shimserver.ShimServer) *http.Server {
+	hs := &http.Server{
+		Addr:      addr,
+		Handler:   shim.BundleEndpointHandler(),
+		TLSConfig: shim.BundleEndpointTLSConfig(),
+	}
+	go func() {
+		if err := hs.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("bundle endpoint error", "error", err)
+		}
+	}()
+	slog.Info("serving SPIFFE bundle endpoint", "addr", "https://"+addr)
+	return hs
+}
+
+// defaultCredsDir is the credentials directory used when --creds-dir is not given.
+const defaultCredsDir = "/var/run/secrets/workload-spiffe-credentials"
+
+// defaultSocketPath is the unix socket path used when --socket-path is not given.
+const defaultSocketPath = "/tmp/spiffe-workload-api.sock"
+
+// defaultPipePath is the named pipe path used when --pipe-path is not given.
+const defaultPipePath = `\\.\pipe\spiffe-workload-api`
+
+// stringList is a flag.Value collecting every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseBundleAllow parses the comma-separated --bundle-allow trust domains.
+func parseBundleAllow(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var domains []string
+	for _, v := range strings.Split(value, ",") {
+		td, err := spiffeid.TrustDomainFromString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", v, err)
+		}
+		domains = append(domains, td.Name())
+	}
+	return domains, nil
+}
 
-func workloadHeaderUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok || len(md.Get(workloadHeader)) == 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "missing required header: %s", workloadHeader)
+// parseFederation parses --federate values of the form domain=url.
+func parseFederation(values []string) (map[string]string, error) {
+	federation := make(map[string]string, len(values))
+	for _, v := range values {
+		domain, url, ok := strings.Cut(v, "=")
+		if !ok || domain == "" || url == "" {
+			return nil, fmt.Errorf("%q: want domain=url", v)
+		}
+		if !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("%q: bundle endpoint URL must use https", v)
+		}
+		federation[domain] = url
 	}
-	return handler(ctx, req)
+	return federation, nil
 }
 
-func workloadHeaderStreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	md, ok := metadata.FromIncomingContext(ss.Context())
-	if !ok || len(md.Get(workloadHeader)) == 0 {
-		return status.Errorf(codes.InvalidArgument, "missing required header: %s", workloadHeader)
+// parseNotifiers builds the rotation notifiers of the --on-rotate-exec and
+// --on-rotate-webhook flags. The command is split on whitespace and run
+// without a shell.
+func parseNotifiers(execCmd, webhook string) ([]shimserver.Notifier, error) {
+	var notifiers []shimserver.Notifier
+	if args := strings.Fields(execCmd); len(args) > 0 {
+		notifiers = append(notifiers, shimserver.ExecNotifier{Args: args})
+	}
+	if webhook != "" {
+		if !strings.HasPrefix(webhook, "http://") && !strings.HasPrefix(webhook, "https://") {
+			return nil, fmt.Errorf("%q: webhook URL must use http or https", webhook)
+		}
+		notifiers = append(notifiers, shimserver.WebhookNotifier{URL: webhook})
 	}
-	return handler(srv, ss)
+	return notifiers, nil
 }
 
 func main() {
-	socketPath := flag.String("socket-path", "/tmp/spiffe-workload-api.sock", "Unix domain socket path")
-	credsDir := flag.String("creds-dir", "/var/run/secrets/workload-spiffe-credentials", "Directory containing SPIFFE credential files")
+	listenNetwork := flag.String("listen-network", "unix", "Listener network: unix, tcp, or npipe for a Windows named pipe")
+	var socketPaths stringList
+	flag.Var(&socketPaths, "socket-path", "Unix domain socket path (unix network); a leading @ names a Linux abstract socket. Repeat to serve the same Workload API on several sockets (default: "+defaultSocketPath+")")
+	socketMode := flag.String("socket-mode", "", "Octal file mode applied to the socket, e.g. 0660 (default: inherited from umask)")
+	socketDirMode := flag.String("socket-dir-mode", "0755", "Octal mode of the socket file's parent directories when the shim creates them, regardless of the umask")
+	socketGID := flag.Int("socket-gid", -1, "Group ID applied to the socket (default: unchanged)")
+	pipePath := flag.String("pipe-path", defaultPipePath, "Named pipe path (npipe network)")
+	pipeSDDL := flag.String("pipe-sddl", "", "Security descriptor in SDDL form applied to the named pipe, e.g. D:P(A;;GA;;;SY)(A;;GRGW;;;BU) (default: the Windows default for named pipes)")
+	listenAddr := flag.String("listen-addr", "127.0.0.1:8081", "TCP address to listen on (tcp network)")
+	tlsCert := flag.String("tls-cert", "", "PEM server certificate chain of the TCP listener; with --tls-key and --tls-client-ca enables mutual TLS")
+	tlsKey := flag.String("tls-key", "", "PEM private key of --tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA certificates that TCP clients' certificates must chain to")
+	insecureTCP := flag.Bool("insecure", false, "Allow --listen-network tcp without TLS; anything that can reach the address can fetch the SVID and its key")
+	var credsDirs stringList
+	flag.Var(&credsDirs, "creds-dir", "Directory containing SPIFFE credential files; repeat to search several directories in order (default: "+defaultCredsDir+")")
+	credsLayout := flag.String("creds-layout", "spiffe-helper", "File naming convention of the credential provider: spiffe-helper, k8s-tls (tls.crt, tls.key, ca.crt) or sds-json (a single Envoy SDS document)")
+	sdsFile := flag.String("sds-file", "sds.json", "Basename of the SDS document in the credentials directory with --creds-layout=sds-json")
+	certFile := flag.String("cert-file", "", "Basename of the leaf certificate chain in the credentials directory (default: from --creds-layout)")
+	keyFile := flag.String("key-file", "", "Basename of the leaf private key in the credentials directory (default: from --creds-layout)")
+	caFile := flag.String("ca-file", "", "Basename of the local CA certificates in the credentials directory (default: from --creds-layout)")
+	staticCert := flag.String("static-cert", "", "Path or inline PEM of a leaf certificate chain served instead of the one in --creds-dir, for local development; with --static-key and --static-bundle")
+	staticKey := flag.String("static-key", "", "Path or inline PEM of the private key of --static-cert")
+	staticBundle := flag.String("static-bundle", "", "Path or inline PEM of the local CA certificates served with --static-cert")
+	intermediatesFile := flag.String("intermediates-file", "intermediate_ca.pem", "Basename of an optional PEM file of intermediate CA certificates appended after the leaf of every SVID")
+	stripChainRoot := flag.Bool("strip-chain-root", false, "Remove a self-signed root from the end of the certificate chain served as the X509-SVID, adding it to the SVID bundle when not among the CA certificates")
+	bundlesFile := flag.String("bundles-file", "trust_bundles.json", "Basename of the trust bundles document in the credentials directory")
+	requireBundlesFile := flag.Bool("require-bundles-file", false, "Fail when the trust bundles document is missing instead of serving no federated trust domains")
+	keyPassphraseFile := flag.String("key-passphrase-file", "", "File holding the passphrase of encrypted private key files")
+	p12File := flag.String("p12-file", "", "Basename of a PKCS#12 file in the credentials directory holding the leaf, chain and key, read instead of --cert-file and --key-file")
+	p12PassphraseFile := flag.String("p12-passphrase-file", "", "File holding the passphrase of the --p12-file (default: empty passphrase)")
+	debounce := flag.Duration("debounce", 100*time.Millisecond, "Quiet period after a credential file change before pushing an update")
+	lockFile := flag.String("lock-file", "", "Sentinel file the credential writer holds while rotating, e.g. .rotation-in-progress: a name in --creds-dir or an absolute path. No rotation runs while it exists (disabled when empty)")
+	minRotationInterval := flag.Duration("min-rotation-interval", 0, "Minimum time between pushed updates; changes arriving sooner are coalesced into one update when it has passed (0 disables)")
+	watchMode := flag.String("watch-mode", "fsnotify", "How credential rotation is detected: fsnotify, or poll for filesystems without inotify support such as NFS")
+	pollInterval := flag.Duration("poll-interval", 10*time.Second, "Interval between checks of the credential files in --watch-mode=poll")
+	onRotateExec := flag.String("on-rotate-exec", "", "Command run after every successful rotation, split on whitespace and run without a shell; SPIFFE_ID and ROTATED_AT are set in its environment")
+	onRotateWebhook := flag.String("on-rotate-webhook", "", "URL POSTed a JSON {spiffe_id, rotated_at} object after every successful rotation")
+	writeDir := flag.String("write-dir", "", "Directory the served SVID is written to as svid.pem, svid_key.pem and svid_bundle.pem after every successful rotation, for consumers that only read files (disabled when empty)")
+	watchFiles := flag.Bool("watch-files", false, "Watch the individual credential files by path instead of the whole credentials directory")
+	initialSendRetries := flag.Int("initial-send-retries", 2, "Times a response requested before the credentials were first loaded is rebuilt after failing, 25ms apart and doubling, before the client gets the error (0 disables)")
+	sendTimeout := flag.Duration("send-timeout", 30*time.Second, "Maximum time a client may take to read a response sent on a Fetch stream before the stream is ended with DeadlineExceeded (0 waits indefinitely)")
+	waitForCreds := flag.Duration("wait-for-creds", 0, "Maximum time to wait at startup for the credentials to appear and validate, for credential writers that may start after the shim (0 fails at once)")
+	readTimeout := flag.Duration("read-timeout", 5*time.Second, "Maximum time to wait for a single credential file read or stat before the rebuild is retried (0 waits indefinitely)")
+	var federate stringList
+	flag.Var(&federate, "federate", "Poll a federated trust domain's SPIFFE bundle endpoint, as domain=https-url; repeat for several domains")
+	bundleAllow := flag.String("bundle-allow", "", "Comma-separated federated trust domains served by FetchX509Bundles and FetchJWTBundles; others are left out (default: all). The local trust domain is always served")
+	federationRefresh := flag.Duration("federation-refresh", 5*time.Minute, "Interval between polls of the --federate bundle endpoints")
+	maxStreamLifetime := flag.Duration("max-stream-lifetime", 0, "End each Fetch stream cleanly after it has been open this long, so that clients reconnect and fetch afresh (0 keeps streams open)")
+	maxStreams := flag.Int("max-streams", 0, "Maximum number of concurrent Fetch streams across all methods; further calls fail with RESOURCE_EXHAUSTED (0 means no limit)")
+	jwtTTL := flag.Duration("jwt-ttl", 5*time.Minute, "Lifetime of JWT-SVIDs minted by FetchJWTSVID")
+	includeLocalJWTBundle := flag.Bool("include-local-jwt-bundle", false, "Always serve a JWT bundle for the local trust domain, adding the public key of jwt_signing_key.pem to it")
+	jwtKeyID := flag.String("jwt-key-id", "", "kid header of minted JWT-SVIDs (default: JWK thumbprint of the signing key)")
+	ageLogInterval := flag.Duration("credentials-age-log-interval", 0, "Interval at which the age of the served credentials is logged (0 disables)")
+	expiryWarn := flag.Duration("expiry-warn", time.Hour, "Log a warning when a leaf certificate has less than this validity remaining (0 disables)")
+	verifyChain := flag.Bool("verify-chain", false, "Refuse to serve a leaf certificate that does not chain to the CA certificates, keeping the last good response")
+	rejectExpired := flag.Bool("reject-expired", false, "Refuse to serve expired or not-yet-valid leaf certificates, keeping the last good response")
+	strictSPIFFEID := flag.Bool("strict-spiffe-id", false, "Refuse to serve leaf certificates whose URI SAN is not a valid SPIFFE ID (by default only the spiffe scheme is required)")
+	strictX509SVID := flag.Bool("strict-x509-svid", false, "Refuse to serve leaf certificates that break the X509-SVID rules: CA certificates, or a key usage without digitalSignature or with keyCertSign/cRLSign")
+	var allowedSPIFFEIDs stringList
+	flag.Var(&allowedSPIFFEIDs, "allowed-spiffe-id", "Refuse to serve a leaf certificate whose SPIFFE ID matches none of these patterns (path.Match globs such as spiffe://example.org/ns/*/sa/*), keeping the last good response; repeat for several")
+	strictURISANs := flag.Bool("strict-uri-sans", false, "Refuse to serve leaf certificates with more than one URI SAN instead of using the first")
+	bundleEndpointAddr := flag.String("bundle-endpoint-addr", "", "Address for the HTTPS SPIFFE bundle endpoint, e.g. :8443 (disabled when empty)")
+	metricsAddr := flag.String("metrics-addr", "", "Address for the Prometheus metrics HTTP listener, e.g. :9090 (disabled when empty)")
+	debugSocket := flag.String("debug-socket", "", "Unix socket path serving the effective configuration and last rebuild status as JSON on GET /status (disabled when empty)")
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/gRPC collector URL traces are exported to, e.g. http://otel-collector:4317 (disabled when empty)")
+	pprofAddr := flag.String("pprof-addr", "", "Address for the net/http/pprof debug listener, e.g. 127.0.0.1:6060 (disabled when empty)")
+	maxRecvMsgSize := flag.Int("grpc-max-recv-msg-size", 0, "Maximum size in bytes of a message the gRPC server accepts (0 keeps the gRPC default of 4 MiB)")
+	maxSendMsgSize := flag.Int("grpc-max-send-msg-size", 0, "Maximum size in bytes of a message the gRPC server sends, e.g. a large bundle map (0 keeps the gRPC default, unlimited)")
+	keepaliveTime := flag.Duration("keepalive-time", 2*time.Hour, "Idle time after which the server pings a client to check the connection is alive")
+	keepaliveTimeout := flag.Duration("keepalive-timeout", 20*time.Second, "Time the server waits for a ping ack before closing the connection")
+	keepaliveMinTime := flag.Duration("keepalive-min-time", 5*time.Minute, "Minimum interval between client keepalive pings; clients pinging more often are disconnected")
+	keepalivePermitWithoutStream := flag.Bool("keepalive-permit-without-stream", false, "Allow client keepalive pings on connections without an open stream")
+	relistenAttempts := flag.Int("relisten-attempts", 0, "Times to re-create the Workload API listener after it fails or its socket file is removed, before exiting (0 exits on the first failure)")
+	relistenBackoff := flag.Duration("relisten-backoff", time.Second, "Wait before the first re-listen attempt, doubled after each failed attempt up to 30s")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Maximum time to wait for in-flight streams to finish before forcing shutdown")
+	logCallers := flag.Bool("log-callers", false, "Log every Workload API call with the uid, gid and pid of the calling process (unix sockets on Linux) or its address")
+	requireHeader := flag.String("require-header", defaultWorkloadHeader, "gRPC metadata header every Workload API call must carry")
+	noRequireHeader := flag.Bool("no-require-header", false, "Accept calls without the required header")
+	dump := flag.Bool("dump", false, "Print the responses the shim would serve as JSON and exit")
+	printJWKS := flag.String("print-jwks", "", "Print the JWKS FetchJWTBundles would serve for this trust domain, or for every trust domain with \"all\", and exit")
+	check := flag.Bool("check", false, "Fetch one X.509 SVID from the running shim's listener and exit 0 if a SPIFFE ID is returned, 1 otherwise")
+	checkTimeout := flag.Duration("check-timeout", 5*time.Second, "Maximum time --check waits for a response")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn, or error")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	configFile := flag.String("config", "", "JSON file of flag values, applied to flags not set on the command line or in the environment; log-level, debounce and bundle-allow are re-read on SIGHUP")
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fatal("invalid environment variable", "error", err)
+	}
+	fixedFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { fixedFlags[f.Name] = true })
+	var configValues map[string][]string
+	if *configFile != "" {
+		values, err := readConfig(*configFile)
+		if err == nil {
+			err = applyConfig(flag.CommandLine, values, fixedFlags)
+		}
+		if err != nil {
+			fatal("invalid --config file", "error", err)
+		}
+		configValues = values
+	}
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	staticSet := *staticCert != "" || *staticKey != "" || *staticBundle != ""
+	if len(credsDirs) == 0 && !staticSet {
+		credsDirs = stringList{defaultCredsDir}
+	}
+	if len(socketPaths) == 0 {
+		socketPaths = stringList{defaultSocketPath}
+	}
 
-	os.Remove(*socketPath)
-
-	lis, err := net.Listen("unix", *socketPath)
+	logger, logLevelVar, err := newLogger(*logLevel, *logFormat)
 	if err != nil {
-		log.Fatalf("failed to listen on %s: %v", *socketPath, err)
+		fatal("invalid logging flags", "error", err)
+	}
+	slog.SetDefault(logger)
+
+	tlsSet := *tlsCert != "" || *tlsKey != "" || *tlsClientCA != ""
+	if *check {
+		if *listenNetwork == "tcp" && tlsSet {
+			fatal("--check does not support TLS listeners")
+		}
+		header := *requireHeader
+		if *noRequireHeader {
+			header = ""
+		}
+		addr := *listenAddr
+		var dialOpts []grpc.DialOption
+		if *listenNetwork == "npipe" {
+			addr = *pipePath
+			dialOpts = append(dialOpts, pipeDialOption())
+		}
+		target, err := checkTarget(*listenNetwork, socketPaths[0], addr)
+		if err != nil {
+			fatal("check failed", "error", err)
+		}
+		id, err := runCheck(target, header, *checkTimeout, dialOpts...)
+		if err != nil {
+			fatal("check failed", "target", target, "error", err)
+		}
+		slog.Info("check succeeded", "target", target, "spiffe_id", id)
+		return
 	}
 
-	srv := grpc.NewServer(
-		grpc.ChainUnaryInterceptor(workloadHeaderUnaryInterceptor),
-		grpc.ChainStreamInterceptor(workloadHeaderStreamInterceptor),
-	)
-	shim, err := shimserver.New(*credsDir)
+	federation, err := parseFederation(federate)
+	if err != nil {
+		fatal("invalid --federate flag", "error", err)
+	}
+	allowedDomains, err := parseBundleAllow(*bundleAllow)
+	if err != nil {
+		fatal("invalid --bundle-allow flag", "error", err)
+	}
+	notifiers, err := parseNotifiers(*onRotateExec, *onRotateWebhook)
 	if err != nil {
-		log.Fatalf("failed to initialize shim: %v", err)
+		fatal("invalid --on-rotate-webhook flag", "error", err)
+	}
+
+	dirMode, err := strconv.ParseUint(*socketDirMode, 8, 32)
+	if err != nil || dirMode > 0o777 {
+		fatal("invalid --socket-dir-mode", "socket_dir_mode", *socketDirMode)
+	}
+
+	var shutdownTracing func(context.Context) error
+	if *otelEndpoint != "" {
+		if shutdownTracing, err = setupTracing(context.Background(), *otelEndpoint); err != nil {
+			fatal("invalid --otel-endpoint", "error", err)
+		}
+	}
+
+	healthSrv := health.NewServer()
+	cfg := shimserver.Config{
+		CredsDirs:             credsDirs,
+		StaticCert:            *staticCert,
+		StaticKey:             *staticKey,
+		StaticBundle:          *staticBundle,
+		CredsLayout:           *credsLayout,
+		SDSFile:               *sdsFile,
+		CertFile:              *certFile,
+		KeyFile:               *keyFile,
+		CAFile:                *caFile,
+		BundlesFile:           *bundlesFile,
+		IntermediatesFile:     *intermediatesFile,
+		StripChainRoot:        *stripChainRoot,
+		RequireBundlesFile:    *requireBundlesFile,
+		KeyPassphraseFile:     *keyPassphraseFile,
+		P12File:               *p12File,
+		BundleAllow:           allowedDomains,
+		P12PassphraseFile:     *p12PassphraseFile,
+		Debounce:              *debounce,
+		MinRotationInterval:   *minRotationInterval,
+		LockFile:              *lockFile,
+		WatchFiles:            *watchFiles,
+		WatchMode:             *watchMode,
+		PollInterval:          *pollInterval,
+		InitialSendRetries:    *initialSendRetries,
+		ReadTimeout:           *readTimeout,
+		SendTimeout:           *sendTimeout,
+		MaxStreams:            *maxStreams,
+		MaxStreamLifetime:     *maxStreamLifetime,
+		Federation:            federation,
+		FederationRefresh:     *federationRefresh,
+		JWTTTL:                *jwtTTL,
+		JWTKeyID:              *jwtKeyID,
+		IncludeLocalJWTBundle: *includeLocalJWTBundle,
+		ExpiryWarn:            *expiryWarn,
+		AgeLogInterval:        *ageLogInterval,
+		RejectExpired:         *rejectExpired,
+		VerifyChain:           *verifyChain,
+		StrictURISANs:         *strictURISANs,
+		StrictSPIFFEID:        *strictSPIFFEID,
+		StrictX509SVID:        *strictX509SVID,
+		AllowedSPIFFEIDs:      allowedSPIFFEIDs,
+		WriteDir:              *writeDir,
+		Notifiers:             notifiers,
+		Health:                healthSrv,
+	}
+	var shim *shimserver.ShimServer
+	if *waitForCreds > 0 {
+		shim, err = waitForCredentials(cfg, *waitForCreds)
+		if err != nil {
+			fatal("credentials not available", "creds_dirs", credsDirs.String(), "timeout", *waitForCreds, "error", err)
+		}
+	} else if shim, err = shimserver.New(cfg); err != nil {
+		fatal("failed to initialize shim", "error", err)
+	}
+	if *dump {
+		err := shim.Dump(os.Stdout)
+		shim.Close()
+		if err != nil {
+			fatal("dump failed", "error", err)
+		}
+		return
+	}
+	if *printJWKS != "" {
+		err := shim.PrintJWKS(os.Stdout, *printJWKS)
+		shim.Close()
+		if err != nil {
+			fatal("print JWKS failed", "error", err)
+		}
+		return
+	}
+	if err := shim.Validate(); err != nil {
+		fatal("invalid credentials", "creds_dirs", credsDirs.String(), "error", err)
+	}
+	shim.LogSummary()
+
+	if *pipeSDDL != "" && *listenNetwork != "npipe" {
+		fatal("--pipe-sddl applies only to --listen-network npipe")
+	}
+	var listeners []*workloadListener
+	if *listenNetwork == "unix" {
+		seen := make(map[string]bool)
+		for _, path := range socketPaths {
+			if seen[path] {
+				fatal("duplicate --socket-path", "socket_path", path)
+			}
+			seen[path] = true
+			listeners = append(listeners, &workloadListener{network: "unix", socketPath: path, socketMode: *socketMode, socketGID: *socketGID, dirMode: os.FileMode(dirMode)})
+		}
+	} else if *listenNetwork == "npipe" {
+		listeners = []*workloadListener{{network: "npipe", addr: *pipePath, pipeSDDL: *pipeSDDL}}
+	} else {
+		listeners = []*workloadListener{{network: *listenNetwork, addr: *listenAddr}}
+	}
+	var addrs []string
+	for _, l := range listeners {
+		if l.network == "unix" && !l.socketFile() && (*socketMode != "" || *socketGID >= 0) {
+			fatal("--socket-mode and --socket-gid do not apply to abstract unix sockets", "socket_path", l.socketPath)
+		}
+		if l.lis, err = l.open(); err != nil {
+			fatal("failed to listen", "error", err)
+		}
+		addrs = append(addrs, l.String())
 	}
+
+	var transportCreds credentials.TransportCredentials
+	switch {
+	case *listenNetwork != "tcp" && (tlsSet || *insecureTCP):
+		fatal("--tls-cert, --tls-key, --tls-client-ca and --insecure apply only to --listen-network tcp")
+	case *listenNetwork == "tcp" && tlsSet:
+		if transportCreds, err = serverTLSCredentials(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			fatal("invalid TLS flags", "error", err)
+		}
+	case *listenNetwork == "tcp" && !*insecureTCP:
+		fatal("--listen-network tcp requires --tls-cert, --tls-key and --tls-client-ca, or --insecure to serve without TLS")
+	case *listenNetwork != "tcp" && *logCallers:
+		if peerCredSupported {
+			transportCreds = peerCredTransport{}
+		} else {
+			slog.Warn("peer credentials are only available on Linux; --log-callers logs no uid, gid or pid")
+		}
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    *keepaliveTime,
+			Timeout: *keepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *keepaliveMinTime,
+			PermitWithoutStream: *keepalivePermitWithoutStream,
+		}),
+	}
+	if transportCreds != nil {
+		serverOpts = append(serverOpts, grpc.Creds(transportCreds))
+	}
+	if *maxRecvMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(*maxRecvMsgSize))
+	}
+	if *maxSendMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxSendMsgSize(*maxSendMsgSize))
+	}
+	if shutdownTracing != nil {
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(tracingUnaryInterceptor()),
+			grpc.ChainStreamInterceptor(tracingStreamInterceptor()),
+		)
+	}
+	if *logCallers {
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(callerLogUnaryInterceptor()),
+			grpc.ChainStreamInterceptor(callerLogStreamInterceptor()),
+		)
+	}
+	if !*noRequireHeader {
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(workloadHeaderUnaryInterceptor(*requireHeader)),
+			grpc.ChainStreamInterceptor(workloadHeaderStreamInterceptor(*requireHeader)),
+		)
+	}
+	srv := grpc.NewServer(serverOpts...)
 	workloadv1.RegisterSpiffeWorkloadAPIServer(srv, shim)
+	healthpb.RegisterHealthServer(srv, healthSrv)
 	reflection.Register(srv)
 
-	log.Printf("serving SPIFFE Workload API on unix://%s", *socketPath)
-	if err := srv.Serve(lis); err != nil {
-		log.Fatalf("server error: %v", err)
+	var metricsSrv *http.Server
+	if *metricsAddr != "" {
+		metricsSrv = startMetricsServer(*metricsAddr)
+	}
+	var pprofSrv *http.Server
+	if *pprofAddr != "" {
+		pprofSrv = startPprofServer(*pprofAddr)
+	}
+	var bundleSrv *http.Server
+	if *bundleEndpointAddr != "" {
+		bundleSrv = startBundleEndpoint(*bundleEndpointAddr, shim)
+	}
+	var debugSrv *http.Server
+	if *debugSocket != "" {
+		debugSrv, err = startDebugServer(*debugSocket, strings.Join(addrs, ","), shim)
+		if err != nil {
+			fatal("failed to start debug server", "path", *debugSocket, "error", err)
+		}
+	}
+
+	// Every listener is served by the same grpc.Server, so streams on all of
+	// them share the ShimServer's rotation broadcaster.
+	serveErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		var watchedSocket string
+		if l.socketFile() {
+			watchedSocket = l.socketPath
+		}
+		go func() {
+			serveErr <- serve(srv, l.lis, l.open, *relistenAttempts, *relistenBackoff, watchedSocket)
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	if len(drainSignals) > 0 {
+		drainCh := make(chan os.Signal, 1)
+		signal.Notify(drainCh, drainSignals...)
+		go func() {
+			for sig := range drainCh {
+				slog.Info("drain requested", "signal", sig.String())
+				shim.Drain()
+			}
+		}()
+	}
+
+	if *configFile != "" && len(reloadSignals) > 0 {
+		reloader := &configReloader{
+			path:     *configFile,
+			fs:       flag.CommandLine,
+			fixed:    fixedFlags,
+			applied:  configValues,
+			level:    logLevelVar,
+			shim:     shim,
+			settings: shimserver.Settings{Debounce: *debounce, BundleAllow: allowedDomains},
+		}
+		reloadCh := make(chan os.Signal, 1)
+		signal.Notify(reloadCh, reloadSignals...)
+		go func() {
+			for sig := range reloadCh {
+				if err := reloader.reload(); err != nil {
+					slog.Error("config reload failed, keeping the current settings", "signal", sig.String(), "config", *configFile, "error", err)
+					continue
+				}
+				slog.Info("config reloaded", "signal", sig.String(), "config", *configFile)
+			}
+		}()
+	}
+
+	v, c, d := buildInfo()
+	slog.Info("serving SPIFFE Workload API", "addr", strings.Join(addrs, ","),
+		"version", v, "commit", c, "build_date", d)
+	select {
+	case err := <-serveErr:
+		fatal("server error", "error", err)
+	case sig := <-sigCh:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+
+	// Closing the shim ends the open Fetch streams; without this GracefulStop
+	// would wait on them until the timeout.
+	healthSrv.Shutdown()
+	shim.Close()
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(*shutdownTimeout):
+		slog.Warn("graceful shutdown timed out, forcing stop", "timeout", *shutdownTimeout)
+		srv.Stop()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	if pprofSrv != nil {
+		pprofSrv.Close()
+	}
+	if bundleSrv != nil {
+		bundleSrv.Close()
+	}
+	if debugSrv != nil {
+		debugSrv.Close()
+		os.Remove(*debugSocket)
+	}
+	if shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("flushing traces failed", "error", err)
+		}
+		cancel()
 	}
+	// Stopping srv closed the listeners, which removed their socket files,
+	// except those replaced by another process (see watchSocket).
+	slog.Info("shutdown complete")
 }
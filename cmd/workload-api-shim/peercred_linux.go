@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredSupported reports whether readPeerCred can identify socket peers.
+const peerCredSupported = true
+
+// readPeerCred returns the uid, gid and pid of the process that connected to
+// conn.
+func readPeerCred(conn *net.UnixConn) (uid, gid uint32, pid int32, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, 0, credErr
+	}
+	return cred.Uid, cred.Gid, cred.Pid, nil
+}
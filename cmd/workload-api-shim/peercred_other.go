@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredSupported reports whether readPeerCred can identify socket peers.
+const peerCredSupported = false
+
+// readPeerCred is only implemented on Linux.
+func readPeerCred(*net.UnixConn) (uid, gid uint32, pid int32, err error) {
+	return 0, 0, 0, errors.New("peer credentials are only supported on Linux")
+}
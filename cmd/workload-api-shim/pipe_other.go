@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"google.golang.org/grpc"
+)
+
+// errPipeUnsupported is returned for the npipe network outside Windows.
+var errPipeUnsupported = errors.New("named pipes are only supported on Windows")
+
+func listenPipe(path, sddl string) (net.Listener, error) {
+	return nil, errPipeUnsupported
+}
+
+func pipeDialOption() grpc.DialOption {
+	return grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return nil, errPipeUnsupported
+	})
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+	"google.golang.org/grpc"
+)
+
+// listenPipe creates a named pipe listener at path, such as
+// \\.\pipe\spiffe-workload-api. An empty sddl keeps the default security
+// descriptor of the pipe.
+func listenPipe(path, sddl string) (net.Listener, error) {
+	return winio.ListenPipe(path, &winio.PipeConfig{SecurityDescriptor: sddl})
+}
+
+// pipeDialOption makes a gRPC client dial its target as a named pipe path.
+func pipeDialOption() grpc.DialOption {
+	return grpc.WithContextDialer(func(ctx context.Context, path string) (net.Conn, error) {
+		return winio.DialPipeContext(ctx, path)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// maxRelistenBackoff caps the doubling delay between re-listen attempts.
+const maxRelistenBackoff = 30 * time.Second
+
+// socketCheckInterval is how often a unix socket file is checked for removal.
+const socketCheckInterval = 5 * time.Second
+
+// serve runs srv on lis until it is stopped. When Serve fails, the listener is
+// re-created with relisten up to attempts times, waiting backoff before the
+// first attempt and doubling the wait after each failed one; the last error is
+// returned once they are exhausted. With attempts of zero the first Serve
+// error is returned as is. A non-empty socketPath is checked every
+// socketCheckInterval, and the listener is closed, and so re-created, when the
+// socket file was removed; see watchSocket.
+func serve(srv *grpc.Server, lis net.Listener, relisten func() (net.Listener, error), attempts int, backoff time.Duration, socketPath string) error {
+	for {
+		stop := make(chan struct{})
+		if socketPath != "" && attempts > 0 {
+			go watchSocket(socketPath, lis, stop)
+		}
+		err := srv.Serve(lis)
+		close(stop)
+		if err == nil || errors.Is(err, grpc.ErrServerStopped) {
+			return nil
+		}
+		delay := backoff
+		for attempt := 1; ; attempt++ {
+			if attempt > attempts {
+				return err
+			}
+			slog.Warn("listener failed, re-creating it", "error", err,
+				"attempt", attempt, "max_attempts", attempts, "delay", delay)
+			time.Sleep(delay)
+			var lerr error
+			if lis, lerr = relisten(); lerr == nil {
+				break
+			}
+			err = lerr
+			delay = min(2*delay, maxRelistenBackoff)
+		}
+		slog.Info("listener re-created", "addr", lis.Addr().String())
+	}
+}
+
+// watchSocket closes lis when the socket file at path is removed, which makes
+// Serve return so that serve re-creates it. A removed socket file does not
+// fail Accept; it only keeps new clients from connecting. A socket file
+// replaced by another process is left to it: closing lis would unlink that
+// process's socket, so lis keeps serving its open connections and no longer
+// removes the path when it is closed.
+func watchSocket(path string, lis net.Listener, stop <-chan struct{}) {
+	orig, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(socketCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			slog.Warn("socket file removed, closing listener", "socket_path", path)
+			lis.Close()
+			return
+		}
+		if !os.SameFile(orig, fi) {
+			slog.Warn("socket file replaced by another process, leaving it in place", "socket_path", path)
+			if ul, ok := lis.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// drainSignals is empty where SIGUSR1 does not exist; Drain is not reachable
+// by signal there.
+var drainSignals []os.Signal
+
+// reloadSignals is empty where SIGHUP cannot be sent; --config is only read
+// at startup there.
+var reloadSignals []os.Signal
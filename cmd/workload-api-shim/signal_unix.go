@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals put the shim in the drain state, see ShimServer.Drain.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals re-read the --config file, see configReloader.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
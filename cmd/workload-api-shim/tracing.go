@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// tracerName names the tracer of the gRPC handler spans.
+const tracerName = "github.com/larkintuckerllc/workload-api-shim/cmd/workload-api-shim"
+
+// setupTracing exports spans over OTLP/gRPC to endpoint, a URL such as
+// http://otel-collector:4317 (https for TLS), and installs the tracer provider
+// globally, which also enables the rebuild and rotation spans of the shim
+// server. The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	v, _, _ := buildInfo()
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName("workload-api-shim"), semconv.ServiceVersion(v)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// endSpan records the gRPC status of err on span and ends it.
+func endSpan(span trace.Span, err error) {
+	st := status.Convert(err)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", st.Code().String()))
+	if err != nil {
+		span.SetStatus(otelcodes.Error, st.Message())
+	}
+	span.End()
+}
+
+func tracingUnaryInterceptor() grpc.UnaryServerInterceptor {
+	tracer := otel.Tracer(tracerName)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if headerExempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, span := tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("rpc.method", info.FullMethod)))
+		resp, err := handler(ctx, req)
+		endSpan(span, err)
+		return resp, err
+	}
+}
+
+// tracingStreamInterceptor spans a Fetch stream from its start to its end,
+// with an event for every response sent on it.
+func tracingStreamInterceptor() grpc.StreamServerInterceptor {
+	tracer := otel.Tracer(tracerName)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if headerExempt(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, span := tracer.Start(ss.Context(), info.FullMethod, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("rpc.method", info.FullMethod)))
+		err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx, span: span})
+		endSpan(span, err)
+		return err
+	}
+}
+
+// tracedStream adds a span event for each message sent on a stream.
+type tracedStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	span trace.Span
+	sent int
+}
+
+func (s *tracedStream) Context() context.Context { return s.ctx }
+
+func (s *tracedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	attrs := append(responseAttrs(m), attribute.Bool("rotation", s.sent > 0))
+	if err != nil {
+		s.span.RecordError(err, trace.WithAttributes(attrs...))
+		return err
+	}
+	s.sent++
+	s.span.AddEvent("sent response", trace.WithAttributes(attrs...))
+	return nil
+}
+
+// responseAttrs returns span attributes describing a Fetch response: the
+// SPIFFE IDs of an SVID response or the trust domains of a bundles response.
+func responseAttrs(m interface{}) []attribute.KeyValue {
+	switch resp := m.(type) {
+	case *workloadv1.X509SVIDResponse:
+		ids := make([]string, 0, len(resp.Svids))
+		for _, svid := range resp.Svids {
+			ids = append(ids, svid.SpiffeId)
+		}
+		return []attribute.KeyValue{attribute.StringSlice("spiffe_ids", ids)}
+	case *workloadv1.X509BundlesResponse:
+		return []attribute.KeyValue{attribute.StringSlice("trust_domains", slices.Sorted(maps.Keys(resp.Bundles)))}
+	case *workloadv1.JWTBundlesResponse:
+		return []attribute.KeyValue{attribute.StringSlice("trust_domains", slices.Sorted(maps.Keys(resp.Bundles)))}
+	}
+	return nil
+}
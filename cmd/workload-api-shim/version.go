@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When commit or date are not stamped they fall back to the VCS information
+// the Go toolchain embeds in the binary.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo returns the version, commit and build date of this binary.
+func buildInfo() (v, c, d string) {
+	c, d = commit, date
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.time":
+				if d == "" {
+					d = setting.Value
+				}
+			}
+		}
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return version, c, d
+}
+
+// versionString formats buildInfo for --version.
+func versionString() string {
+	v, c, d := buildInfo()
+	return fmt.Sprintf("workload-api-shim %s (commit %s, built %s)", v, c, d)
+}
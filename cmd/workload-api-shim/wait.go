@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"time"
+
+	"github.com/larkintuckerllc/workload-api-shim/internal/shimserver"
+)
+
+// credsWaitInterval is how often --wait-for-creds checks the credentials.
+const credsWaitInterval = time.Second
+
+// credsWaitLogInterval is how often an unchanged reason for waiting is logged
+// again.
+const credsWaitLogInterval = 10 * time.Second
+
+// waitForCredentials creates the shim, waiting up to timeout for its
+// credentials to be provisioned: until then, a shim whose credentials do not
+// validate, or whose credentials directory does not exist yet, is closed and
+// created again every credsWaitInterval. Any other failure to create the shim
+// is returned at once. Once timeout has elapsed the last error is returned.
+func waitForCredentials(cfg shimserver.Config, timeout time.Duration) (*shimserver.ShimServer, error) {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	var lastMsg string
+	var lastLog time.Time
+	for {
+		shim, err := shimserver.New(cfg)
+		if err == nil {
+			if err = shim.Validate(); err == nil {
+				if lastMsg != "" {
+					slog.Info("credentials available", "waited", time.Since(start).Round(time.Millisecond))
+				}
+				return shim, nil
+			}
+			shim.Close()
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if time.Now().Add(credsWaitInterval).After(deadline) {
+			return nil, err
+		}
+		if msg := err.Error(); msg != lastMsg || time.Since(lastLog) >= credsWaitLogInterval {
+			slog.Info("waiting for credentials", "waited", time.Since(start).Round(time.Second),
+				"timeout", timeout, "error", err)
+			lastMsg, lastLog = msg, time.Now()
+		}
+		time.Sleep(credsWaitInterval)
+	}
+}
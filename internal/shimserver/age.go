@@ -0,0 +1,83 @@
+package shimserver
+
+import (
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// credentialsModTime is the modification time, in Unix nanoseconds, of the
+// leaf certificates served after the last successful rebuild, or zero before
+// the first one. It backs the shim_credentials_age_seconds gauge.
+var credentialsModTime atomic.Int64
+
+// credentialsAge returns the seconds since credentialsModTime, or zero before
+// the first successful rebuild.
+func credentialsAge() float64 {
+	mod := credentialsModTime.Load()
+	if mod == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, mod)).Seconds()
+}
+
+// servedModTime returns the modification time of the oldest certificate
+// source among the credential sets, so that one set that stopped rotating is
+// not hidden by the others. In-memory credentials, which have no file, report
+// the current time, making the age that of the last successful rebuild.
+func (s *ShimServer) servedModTime() time.Time {
+	d, ok := s.baseSource().(*dirSource)
+	if !ok {
+		return time.Now()
+	}
+	var oldest time.Time
+	for _, set := range s.credentialSets() {
+		name := set.certSource()
+		if s.sdsFile != "" && set.p12File == "" {
+			name = s.sdsFile
+		}
+		path, ok := d.find(name)
+		if slices.Contains(s.staticPaths, name) {
+			path, ok = name, true
+		}
+		if !ok {
+			continue
+		}
+		fi, err := statTimeout(path, s.readTimeout)
+		if err != nil {
+			continue
+		}
+		if oldest.IsZero() || fi.ModTime().Before(oldest) {
+			oldest = fi.ModTime()
+		}
+	}
+	if oldest.IsZero() {
+		return time.Now()
+	}
+	return oldest
+}
+
+// startAgeLog logs the age of the served credentials every ageLogInterval, so
+// that a rotation pipeline that stopped is visible in the logs even when no
+// client is connected.
+func (s *ShimServer) startAgeLog() {
+	go func() {
+		ticker := time.NewTicker(s.ageLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			mod := credentialsModTime.Load()
+			if mod == 0 {
+				slog.Warn("no credentials served yet")
+				continue
+			}
+			modified := time.Unix(0, mod)
+			slog.Info("served credentials age", "age", time.Since(modified).Round(time.Second), "modified", modified.UTC().Format(time.RFC3339))
+		}
+	}()
+}
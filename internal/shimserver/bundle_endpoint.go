@@ -0,0 +1,120 @@
+package shimserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// buildLocalSPIFFEBundle builds the SPIFFE bundle of the local trust domain:
+// the X.509 authorities from ca_certificates.pem, plus the jwt-svid keys and
+// spiffe_sequence of the local domain's entry in trust_bundles.json.
+func (s *ShimServer) buildLocalSPIFFEBundle() (*spiffebundle.Bundle, error) {
+	svidResp, err := s.x509SVIDResponse()
+	if err != nil {
+		return nil, err
+	}
+	id, err := spiffeid.FromString(svidResp.Svids[0].SpiffeId)
+	if err != nil {
+		return nil, fmt.Errorf("parse local SPIFFE ID: %w", err)
+	}
+	td := id.TrustDomain()
+	bundle := spiffebundle.New(td)
+
+	caDERs, err := s.loadCABundle()
+	if err != nil {
+		return nil, fmt.Errorf("load CA certificates: %w", err)
+	}
+	for _, der := range caDERs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parse CA certificate: %w", err)
+		}
+		bundle.AddX509Authority(cert)
+	}
+
+	tb, err := s.loadTrustBundles()
+	if err != nil {
+		return nil, fmt.Errorf("load trust bundles: %w", err)
+	}
+	entry := tb.TrustDomains[td.Name()]
+	for _, key := range entry.Keys {
+		if key.Use != "jwt-svid" {
+			continue
+		}
+		raw, err := json.Marshal(key)
+		if err != nil {
+			return nil, fmt.Errorf("marshal jwt key: %w", err)
+		}
+		var jwk jose.JSONWebKey
+		if err := jwk.UnmarshalJSON(raw); err != nil {
+			return nil, fmt.Errorf("parse jwt key %q: %w", key.Kid, err)
+		}
+		if err := bundle.AddJWTAuthority(key.Kid, jwk.Key); err != nil {
+			return nil, fmt.Errorf("add jwt key %q: %w", key.Kid, err)
+		}
+	}
+	bundle.SetSequenceNumber(uint64(entry.SpiffeSequence))
+	return bundle, nil
+}
+
+// BundleEndpointHandler serves the local trust domain's bundle as a SPIFFE
+// bundle document, for federation with other trust domains.
+func (s *ShimServer) BundleEndpointHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		bundle, err := s.buildLocalSPIFFEBundle()
+		if err != nil {
+			slog.Error("bundle endpoint: build bundle failed", "error", err)
+			http.Error(w, "bundle unavailable", http.StatusInternalServerError)
+			return
+		}
+		doc, err := bundle.Marshal()
+		if err != nil {
+			slog.Error("bundle endpoint: marshal bundle failed", "error", err)
+			http.Error(w, "bundle unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+}
+
+// BundleEndpointTLSConfig returns a TLS configuration that presents the current
+// primary X.509 SVID, i.e. the https_spiffe bundle endpoint profile. The
+// certificate follows credential rotation.
+func (s *ShimServer) BundleEndpointTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			resp, err := s.x509SVIDResponse()
+			if err != nil {
+				return nil, err
+			}
+			svid := resp.Svids[0]
+			certs, err := x509.ParseCertificates(svid.X509Svid)
+			if err != nil {
+				return nil, fmt.Errorf("parse SVID certificates: %w", err)
+			}
+			key, err := x509.ParsePKCS8PrivateKey(svid.X509SvidKey)
+			if err != nil {
+				return nil, fmt.Errorf("parse SVID private key: %w", err)
+			}
+			chain := make([][]byte, len(certs))
+			for i, c := range certs {
+				chain[i] = c.Raw
+			}
+			return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: certs[0]}, nil
+		},
+	}
+}
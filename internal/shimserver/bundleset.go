@@ -0,0 +1,97 @@
+package shimserver
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// ParseTrustBundles parses a trust_bundles.json document into the X.509 and
+// JWT bundles of its trust domains: the x5c certificates of the x509-svid
+// keys and the public keys of the jwt-svid keys. A trust domain without keys
+// of a use has no bundle in that set. Unlike the rebuilds, which drop what
+// does not parse, any invalid trust domain name or malformed key is an error.
+func ParseTrustBundles(data []byte) (*x509bundle.Set, *jwtbundle.Set, error) {
+	var tb trustBundlesFile
+	if err := json.Unmarshal(data, &tb); err != nil {
+		return nil, nil, err
+	}
+	if err := validateTrustBundles(&tb); err != nil {
+		return nil, nil, err
+	}
+	return tb.bundleSets()
+}
+
+// bundleSets converts the trust domains of tb into go-spiffe bundle sets,
+// returning the joined errors of every trust domain whose keys do not decode.
+func (tb *trustBundlesFile) bundleSets() (*x509bundle.Set, *jwtbundle.Set, error) {
+	x509Set, jwtSet := x509bundle.NewSet(), jwtbundle.NewSet()
+	var errs []error
+	for _, domain := range slices.Sorted(maps.Keys(tb.TrustDomains)) {
+		entry := tb.TrustDomains[domain]
+		td, err := spiffeid.TrustDomainFromString(domain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("trust domain %q: %w", domain, err))
+			continue
+		}
+		certs, err := x509SVIDAuthorities(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("trust domain %s: %w", domain, err))
+			continue
+		}
+		keys, err := jwtSVIDAuthorities(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("trust domain %s: %w", domain, err))
+			continue
+		}
+		if len(certs) > 0 {
+			x509Set.Add(x509bundle.FromX509Authorities(td, certs))
+		}
+		if len(keys) > 0 {
+			jwtSet.Add(jwtbundle.FromJWTAuthorities(td, keys))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+	return x509Set, jwtSet, nil
+}
+
+// jwtSVIDAuthorities decodes the jwt-svid keys in entry into public keys by
+// key ID, returning an error if any of them is not a valid public JWK or has
+// no or a duplicate kid.
+func jwtSVIDAuthorities(entry trustDomainEntry) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for i, key := range entry.Keys {
+		if key.Use != "jwt-svid" {
+			continue
+		}
+		if key.Kid == "" {
+			return nil, fmt.Errorf("jwt-svid key %d has no kid", i)
+		}
+		if _, dup := keys[key.Kid]; dup {
+			return nil, fmt.Errorf("jwt-svid key %d: duplicate kid %q", i, key.Kid)
+		}
+		raw, err := json.Marshal(key)
+		if err != nil {
+			return nil, fmt.Errorf("jwt-svid key %d: %w", i, err)
+		}
+		var jwk jose.JSONWebKey
+		if err := jwk.UnmarshalJSON(raw); err != nil {
+			return nil, fmt.Errorf("decode jwt-svid key %d: %w", i, err)
+		}
+		if !jwk.IsPublic() {
+			return nil, fmt.Errorf("jwt-svid key %d is not a public key", i)
+		}
+		keys[key.Kid] = jwk.Key
+	}
+	return keys, nil
+}
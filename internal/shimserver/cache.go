@@ -0,0 +1,172 @@
+package shimserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"time"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/protobuf/proto"
+)
+
+// rebuild reloads every response from disk and caches the ones that built
+// successfully. A response that fails to build keeps serving its last-good value.
+//
+// Each response is only replaced when the rebuilt one differs, so that each
+// method's streams are only woken for rotations that changed what they are
+// sent: a private_key.pem rotation wakes no bundle stream, and a federated
+// JWT key change wakes neither SVID nor X.509 bundle streams. A trust domain's
+// spiffe_sequence only serves to reject stale bundles; see keepNewerBundles.
+func (s *ShimServer) rebuild() error {
+	return s.rebuildTraced(context.Background())
+}
+
+// rebuildTraced is rebuild with its span started under ctx.
+func (s *ShimServer) rebuildTraced(ctx context.Context) (err error) {
+	_, span := tracer.Start(ctx, "rebuild")
+	s.rebuildMu.Lock()
+	defer s.rebuildMu.Unlock()
+	defer func() {
+		s.lastRebuild.Store(&rebuildStatus{at: time.Now(), err: err})
+		s.endRebuildSpan(span, err)
+	}()
+
+	var errs []error
+	prevSVID := s.x509SVID.Load()
+	svidResp, err := s.buildX509SVIDResponse()
+	if err != nil {
+		rebuildErrorsTotal.WithLabelValues("x509_svid").Inc()
+		errs = append(errs, fmt.Errorf("build X.509 SVID response: %w", err))
+	} else {
+		// An unchanged response keeps its identity, so that SVID streams are
+		// not woken by rotations that only touched the bundles.
+		if prevSVID == nil || !proto.Equal(prevSVID, svidResp) {
+			s.x509SVID.Store(svidResp)
+		}
+		credentialsModTime.Store(s.servedModTime().UnixNano())
+	}
+
+	tb, err := s.loadTrustBundles()
+	if err != nil {
+		rebuildErrorsTotal.WithLabelValues("x509_bundles").Inc()
+		rebuildErrorsTotal.WithLabelValues("jwt_bundles").Inc()
+		errs = append(errs, fmt.Errorf("load trust bundles: %w", err))
+		return errors.Join(errs...)
+	}
+	s.keepNewerBundles(tb)
+	for domain, entry := range tb.TrustDomains {
+		bundleSequence.WithLabelValues(domain).Set(float64(entry.SpiffeSequence))
+	}
+
+	bundlesOK := true
+	if resp, err := s.buildX509BundlesResponse(tb); err != nil {
+		bundlesOK = false
+		rebuildErrorsTotal.WithLabelValues("x509_bundles").Inc()
+		errs = append(errs, fmt.Errorf("build X.509 bundles response: %w", err))
+		// A federated-only response replaces nothing but the absence of one.
+		if resp != nil && s.x509Bundles.Load() == nil {
+			s.x509Bundles.Store(resp)
+		}
+	} else if prev := s.x509Bundles.Load(); prev == nil || !proto.Equal(prev, resp) {
+		s.x509Bundles.Store(resp)
+	}
+	if resp, err := s.buildJWTBundlesResponse(tb); err != nil {
+		bundlesOK = false
+		rebuildErrorsTotal.WithLabelValues("jwt_bundles").Inc()
+		errs = append(errs, fmt.Errorf("build JWT bundles response: %w", err))
+		if resp != nil && s.jwtBundles.Load() == nil {
+			s.jwtBundles.Store(resp)
+		}
+	} else if prev := s.jwtBundles.Load(); prev == nil || !proto.Equal(prev, resp) {
+		s.jwtBundles.Store(resp)
+	}
+	// Only record the sent entries once both bundle responses reflect them,
+	// so that the entries of a failed build are not used by keepNewerBundles.
+	if bundlesOK {
+		for domain, entry := range tb.TrustDomains {
+			if prev, ok := s.sentBundles[domain]; !ok || !reflect.DeepEqual(prev, entry) {
+				slog.Info("trust bundle updated", "trust_domain", domain, "spiffe_sequence", entry.SpiffeSequence)
+			}
+		}
+		s.sentBundles = maps.Clone(tb.TrustDomains)
+	}
+	return errors.Join(errs...)
+}
+
+// keepNewerBundles replaces each trust domain entry of tb whose
+// spiffe_sequence is lower than the last-sent one with the last-sent entry,
+// so that a stale bundle, such as a trust_bundles.json restored from an old
+// backup, never replaces a newer one. An entry of the same sequence is taken,
+// so that a bundle whose keys changed without a sequence bump is still sent.
+// An entry without a sequence is not ordered and always taken.
+func (s *ShimServer) keepNewerBundles(tb *trustBundlesFile) {
+	for domain, entry := range tb.TrustDomains {
+		prev, ok := s.sentBundles[domain]
+		if !ok || entry.SpiffeSequence == 0 || entry.SpiffeSequence >= prev.SpiffeSequence {
+			continue
+		}
+		slog.Warn("ignoring trust bundle with older spiffe_sequence, keeping the previous one",
+			"trust_domain", domain, "spiffe_sequence", entry.SpiffeSequence, "previous", prev.SpiffeSequence)
+		tb.TrustDomains[domain] = prev
+	}
+}
+
+// x509SVIDResponse returns the cached X.509 SVID response, building it from
+// disk if no rebuild has succeeded yet.
+func (s *ShimServer) x509SVIDResponse() (*workloadv1.X509SVIDResponse, error) {
+	var resp *workloadv1.X509SVIDResponse
+	err := s.withRetry(s.initialSendBackoff, func() (err error) {
+		if resp = s.x509SVID.Load(); resp != nil {
+			return nil
+		}
+		resp, err = s.buildX509SVIDResponse()
+		return err
+	})
+	return resp, err
+}
+
+// x509BundlesResponse returns the cached X.509 bundles response, building it
+// from disk if no rebuild has succeeded yet.
+func (s *ShimServer) x509BundlesResponse() (*workloadv1.X509BundlesResponse, error) {
+	var resp *workloadv1.X509BundlesResponse
+	err := s.withRetry(s.initialSendBackoff, func() error {
+		if resp = s.x509Bundles.Load(); resp != nil {
+			return nil
+		}
+		tb, err := s.loadTrustBundles()
+		if err != nil {
+			return fmt.Errorf("load trust bundles: %w", err)
+		}
+		resp, err = s.buildX509BundlesResponse(tb)
+		if resp != nil && errors.Is(err, errLocalBundleUnavailable) {
+			return nil
+		}
+		return err
+	})
+	return resp, err
+}
+
+// jwtBundlesResponse returns the cached JWT bundles response, building it from
+// disk if no rebuild has succeeded yet.
+func (s *ShimServer) jwtBundlesResponse() (*workloadv1.JWTBundlesResponse, error) {
+	var resp *workloadv1.JWTBundlesResponse
+	err := s.withRetry(s.initialSendBackoff, func() error {
+		if resp = s.jwtBundles.Load(); resp != nil {
+			return nil
+		}
+		tb, err := s.loadTrustBundles()
+		if err != nil {
+			return fmt.Errorf("load trust bundles: %w", err)
+		}
+		resp, err = s.buildJWTBundlesResponse(tb)
+		if resp != nil && errors.Is(err, errLocalBundleUnavailable) {
+			return nil
+		}
+		return err
+	})
+	return resp, err
+}
@@ -0,0 +1,167 @@
+package shimserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/protobuf/proto"
+)
+
+// bundleStreams opens an X.509 and a JWT bundles stream and receives their
+// initial responses.
+func bundleStreams(t *testing.T, client workloadv1.SpiffeWorkloadAPIClient) (*receiver[*workloadv1.X509BundlesResponse], *receiver[*workloadv1.JWTBundlesResponse]) {
+	t.Helper()
+	x509Stream, err := client.FetchX509Bundles(streamCtx(t), &workloadv1.X509BundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtStream, err := client.FetchJWTBundles(streamCtx(t), &workloadv1.JWTBundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509Recv, jwtRecv := receive(x509Stream.Recv), receive(jwtStream.Recv)
+	x509Recv.next(t)
+	jwtRecv.next(t)
+	return x509Recv, jwtRecv
+}
+
+func TestKeyOnlyRotationSendsNoBundles(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	svidStream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svidRecv := receive(svidStream.Recv)
+	svidRecv.next(t)
+	x509Recv, jwtRecv := bundleStreams(t, client)
+
+	tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, testSPIFFEID)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	resp := svidRecv.next(t)
+	if string(resp.Svids[0].X509SvidKey) == "" {
+		t.Fatal("rotated SVID has no key")
+	}
+	x509Recv.none(t, 300*time.Millisecond)
+	jwtRecv.none(t, 0)
+}
+
+func TestSameContentRotationSendsNothing(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	x509Recv, jwtRecv := bundleStreams(t, client)
+
+	// A new spiffe_sequence alone leaves the served bundles unchanged.
+	tf.setBundles(t, 2, 2)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	x509Recv.none(t, 300*time.Millisecond)
+	jwtRecv.none(t, 0)
+}
+
+func TestJWTKeyRotationWithoutSequenceBumpSendsJWTBundles(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	x509Recv, jwtRecv := bundleStreams(t, client)
+
+	tf.other = newECKey(t)
+	tf.setBundles(t, 1, 1)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	resp := jwtRecv.next(t)
+	var jwks struct {
+		Keys []trustKey `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Bundles["spiffe://other.org"], &jwks); err != nil {
+		t.Fatal(err)
+	}
+	want := jwtTrustKey(t, "k1", tf.other.Public())
+	if len(jwks.Keys) != 1 || jwks.Keys[0].X != want.X || jwks.Keys[0].Y != want.Y {
+		t.Fatalf("JWT bundle of other.org = %+v, want the rotated key %+v", jwks.Keys, want)
+	}
+	x509Recv.none(t, 300*time.Millisecond)
+}
+
+func TestOlderBundleSequenceIsRejected(t *testing.T) {
+	tf := newTestFiles(t)
+	tf.setBundles(t, 1, 5)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	_, jwtRecv := bundleStreams(t, client)
+	before := shim.jwtBundles.Load()
+
+	tf.other = newECKey(t)
+	tf.setBundles(t, 1, 4)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	jwtRecv.none(t, 300*time.Millisecond)
+	if !proto.Equal(shim.jwtBundles.Load(), before) {
+		t.Fatal("a bundle with an older spiffe_sequence replaced the served one")
+	}
+
+	// A newer sequence is taken again.
+	tf.setBundles(t, 1, 6)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	jwtRecv.next(t)
+}
+
+func TestBundleChangeWakesOnlyItsStreams(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		change    func(t *testing.T, tf *testFiles)
+		x509, jwt bool
+	}{
+		{"jwt only", func(t *testing.T, tf *testFiles) {
+			tf.other = newECKey(t)
+			tf.setBundles(t, 1, 2)
+		}, false, true},
+		{"x509 only", func(t *testing.T, tf *testFiles) {
+			other := newTestCA(t)
+			tf.files["trust_bundles.json"] = trustBundlesJSON(t, map[string]trustDomainEntry{
+				"example.org": {SpiffeSequence: 1, Keys: []trustKey{x509TrustKey(tf.ca.cert)}},
+				"other.org": {SpiffeSequence: 2, Keys: []trustKey{
+					x509TrustKey(other.cert),
+					jwtTrustKey(t, "k1", tf.other.Public()),
+				}},
+			})
+		}, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf := newTestFiles(t)
+			shim, client := startTestServer(t, Config{Files: tf.clone()})
+			svidStream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			svidRecv := receive(svidStream.Recv)
+			svidRecv.next(t)
+			x509Recv, jwtRecv := bundleStreams(t, client)
+
+			tc.change(t, tf)
+			if err := shim.SetFiles(tf.clone()); err != nil {
+				t.Fatal(err)
+			}
+			if tc.x509 {
+				x509Recv.next(t)
+			}
+			if tc.jwt {
+				jwtRecv.next(t)
+			}
+			svidRecv.none(t, 300*time.Millisecond)
+			if !tc.x509 {
+				x509Recv.none(t, 0)
+			}
+			if !tc.jwt {
+				jwtRecv.none(t, 0)
+			}
+		})
+	}
+}
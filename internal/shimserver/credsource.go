@@ -0,0 +1,183 @@
+package shimserver
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// credSource supplies the contents of credential files by basename. The
+// filesystem implementation reads credsDirs; the in-memory one lets tests and
+// embedders run a ShimServer without touching disk.
+type credSource interface {
+	// read returns the contents of name from the first location holding it.
+	// A missing file is reported with an error wrapping os.ErrNotExist.
+	read(name string) ([]byte, error)
+	// readAll returns every copy of name in precedence order, for files that
+	// are merged across locations such as the trust bundles document.
+	readAll(name string) ([]credFile, error)
+	// exists reports whether any location holds name.
+	exists(name string) bool
+}
+
+// credFile is one copy of a credential file returned by credSource.readAll.
+type credFile struct {
+	path string
+	data []byte
+}
+
+// dirSource reads credential files from a list of directories, searched in
+// order.
+type dirSource struct {
+	dirs        []string
+	readTimeout time.Duration
+}
+
+func (d *dirSource) find(name string) (string, bool) {
+	for _, dir := range d.dirs {
+		path := filepath.Join(dir, name)
+		if _, err := statTimeout(path, d.readTimeout); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// read reads name from the first directory that contains it. When no
+// directory does, the read is attempted in the first directory so the error
+// names a concrete path. Without any directory, as with static credentials
+// only, every file is missing.
+func (d *dirSource) read(name string) ([]byte, error) {
+	if len(d.dirs) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	path, ok := d.find(name)
+	if !ok {
+		path = filepath.Join(d.dirs[0], name)
+	}
+	return readFileTimeout(path, d.readTimeout)
+}
+
+func (d *dirSource) readAll(name string) ([]credFile, error) {
+	if len(d.dirs) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	var files []credFile
+	var firstErr error
+	for _, dir := range d.dirs {
+		path := filepath.Join(dir, name)
+		data, err := readFileTimeout(path, d.readTimeout)
+		if errors.Is(err, fs.ErrNotExist) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, credFile{path: path, data: data})
+	}
+	if len(files) == 0 {
+		return nil, firstErr
+	}
+	return files, nil
+}
+
+func (d *dirSource) exists(name string) bool {
+	_, ok := d.find(name)
+	return ok
+}
+
+// memSource serves credential files from memory, keyed by basename.
+type memSource struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+func newMemSource(files map[string][]byte) *memSource {
+	return &memSource{files: maps.Clone(files)}
+}
+
+// set replaces every file with the contents of files.
+func (m *memSource) set(files map[string][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files = maps.Clone(files)
+}
+
+func (m *memSource) read(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (m *memSource) readAll(name string) ([]credFile, error) {
+	data, err := m.read(name)
+	if err != nil {
+		return nil, err
+	}
+	return []credFile{{path: name, data: data}}, nil
+}
+
+func (m *memSource) exists(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.files[name]
+	return ok
+}
+
+// readFileTimeout reads path, giving up once timeout has elapsed so that a hung
+// network filesystem cannot wedge the watcher. The timeout error is retried
+// like any other rebuild failure. A zero timeout waits indefinitely.
+func readFileTimeout(path string, timeout time.Duration) ([]byte, error) {
+	return fsTimeout(timeout, func() ([]byte, error) { return os.ReadFile(path) })
+}
+
+// statTimeout is os.Stat bounded like readFileTimeout, for the existence and
+// change checks of the rebuild and the watcher.
+func statTimeout(path string, timeout time.Duration) (os.FileInfo, error) {
+	return fsTimeout(timeout, func() (os.FileInfo, error) { return os.Stat(path) })
+}
+
+// lstatTimeout is os.Lstat bounded like readFileTimeout.
+func lstatTimeout(path string, timeout time.Duration) (os.FileInfo, error) {
+	return fsTimeout(timeout, func() (os.FileInfo, error) { return os.Lstat(path) })
+}
+
+// fsTimeout runs the filesystem call fn, returning context.DeadlineExceeded
+// once timeout has elapsed. The abandoned call keeps running in the
+// background until the filesystem returns, since a blocked system call
+// cannot be interrupted. A zero timeout waits indefinitely.
+func fsTimeout[T any](timeout time.Duration, fn func() (T, error)) (T, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := fn()
+		ch <- result{v, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-timer.C:
+		var zero T
+		return zero, context.DeadlineExceeded
+	}
+}
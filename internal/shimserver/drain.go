@@ -0,0 +1,25 @@
+package shimserver
+
+import (
+	"log/slog"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Drain puts the server in the drain state, for handing over to a new
+// instance: new Fetch calls fail with Unavailable and the health status turns
+// NOT_SERVING, while open streams keep receiving rotation updates until they
+// end or the server is closed. It cannot be undone.
+func (s *ShimServer) Drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+	slog.Info("draining: rejecting new Fetch calls, open streams keep receiving updates")
+	s.setHealth(false)
+}
+
+// drainingError is returned to Fetch calls made while draining.
+func drainingError() error {
+	return status.Error(codes.Unavailable, "server is draining")
+}
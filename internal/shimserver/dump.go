@@ -0,0 +1,100 @@
+package shimserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Dump builds every streamed response directly from disk and writes them to w
+// as a JSON object, with DER and JWKS fields base64-encoded as in the proto JSON
+// mapping. It reports what the shim would serve without needing a gRPC client.
+func (s *ShimServer) Dump(w io.Writer) error {
+	svidResp, err := s.buildX509SVIDResponse()
+	if err != nil {
+		return fmt.Errorf("build X.509 SVID response: %w", err)
+	}
+	tb, err := s.loadTrustBundles()
+	if err != nil {
+		return fmt.Errorf("load trust bundles: %w", err)
+	}
+	x509Resp, err := s.buildX509BundlesResponse(tb)
+	if err != nil {
+		return fmt.Errorf("build X.509 bundles response: %w", err)
+	}
+	jwtResp, err := s.buildJWTBundlesResponse(tb)
+	if err != nil {
+		return fmt.Errorf("build JWT bundles response: %w", err)
+	}
+
+	out := make(map[string]json.RawMessage)
+	for name, msg := range map[string]proto.Message{
+		"x509_svid":    svidResp,
+		"x509_bundles": x509Resp,
+		"jwt_bundles":  jwtResp,
+	} {
+		b, err := protojson.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshal %s: %w", name, err)
+		}
+		out[name] = b
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// PrintJWKS builds the FetchJWTBundles response directly from disk and writes
+// the JWKS of trust domain domain to w, indented. With domain "all" it writes
+// a JSON object mapping the SPIFFE ID of every served trust domain to its
+// JWKS. The JWKS are the bytes a client would receive, so it shows how the
+// jwt-svid keys of trust_bundles.json are parsed and serialized. A local
+// trust domain that cannot be loaded only fails the call when no federated
+// JWKS is left to print.
+func (s *ShimServer) PrintJWKS(w io.Writer, domain string) error {
+	var want string
+	if domain != "all" {
+		td, err := spiffeid.TrustDomainFromString(domain)
+		if err != nil {
+			return fmt.Errorf("invalid trust domain %q: %w", domain, err)
+		}
+		want = td.IDString()
+	}
+	tb, err := s.loadTrustBundles()
+	if err != nil {
+		return fmt.Errorf("load trust bundles: %w", err)
+	}
+	resp, err := s.buildJWTBundlesResponse(tb)
+	if resp == nil {
+		return fmt.Errorf("build JWT bundles response: %w", err)
+	}
+
+	var out bytes.Buffer
+	if want != "" {
+		jwks, ok := resp.Bundles[want]
+		if !ok {
+			return fmt.Errorf("no JWT bundle served for trust domain %s", want)
+		}
+		if err := json.Indent(&out, jwks, "", "  "); err != nil {
+			return fmt.Errorf("indent jwks for %s: %w", want, err)
+		}
+	} else {
+		all := make(map[string]json.RawMessage, len(resp.Bundles))
+		for id, jwks := range resp.Bundles {
+			all[id] = jwks
+		}
+		b, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal jwks: %w", err)
+		}
+		out.Write(b)
+	}
+	out.WriteByte('\n')
+	_, err = w.Write(out.Bytes())
+	return err
+}
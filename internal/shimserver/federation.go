@@ -0,0 +1,157 @@
+package shimserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// maxBundleSize caps the size of a fetched SPIFFE bundle document.
+const maxBundleSize = 1 << 20
+
+// federationClient fetches federated bundles. Endpoints are authenticated with
+// the system roots, i.e. the https_web bundle endpoint profile.
+var federationClient = &http.Client{Timeout: 10 * time.Second}
+
+// startFederation polls every configured federation bundle endpoint once
+// immediately and then every federationRefresh, merging changed bundles into
+// the served responses.
+func (s *ShimServer) startFederation() {
+	domains := make([]string, 0, len(s.federation))
+	for domain := range s.federation {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	go func() {
+		ticker := time.NewTicker(s.federationRefresh)
+		defer ticker.Stop()
+		for {
+			changed := false
+			for _, domain := range domains {
+				if s.refreshFederatedBundle(domain) {
+					changed = true
+				}
+			}
+			if changed {
+				s.rotate()
+			}
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refreshFederatedBundle fetches the bundle of domain and stores it, reporting
+// whether it differs from the stored one. A bundle whose spiffe_sequence went
+// backwards is ignored as stale; one with the same or no sequence but other
+// keys is stored, and the rebuild serves it because its content changed.
+func (s *ShimServer) refreshFederatedBundle(domain string) bool {
+	url := s.federation[domain]
+	bundle, err := fetchSPIFFEBundle(domain, url)
+	if err != nil {
+		federationFetchErrorsTotal.WithLabelValues(domain).Inc()
+		slog.Warn("federation: fetch bundle failed, keeping the previous one",
+			"trust_domain", domain, "url", url, "error", err)
+		return false
+	}
+
+	s.fedMu.Lock()
+	defer s.fedMu.Unlock()
+	prev := s.fedBundles[domain]
+	if prev != nil {
+		if prev.Equal(bundle) {
+			return false
+		}
+		prevSeq, prevOK := prev.SequenceNumber()
+		seq, ok := bundle.SequenceNumber()
+		if ok && prevOK && seq < prevSeq {
+			slog.Warn("federation: ignoring bundle with older spiffe_sequence",
+				"trust_domain", domain, "spiffe_sequence", seq, "previous", prevSeq)
+			return false
+		}
+	}
+	s.fedBundles[domain] = bundle
+	seq, _ := bundle.SequenceNumber()
+	slog.Info("federation: fetched bundle", "trust_domain", domain, "spiffe_sequence", seq)
+	return true
+}
+
+// fetchSPIFFEBundle downloads and parses the SPIFFE bundle document of domain.
+func fetchSPIFFEBundle(domain, url string) (*spiffebundle.Bundle, error) {
+	td, err := spiffeid.TrustDomainFromString(domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust domain: %w", err)
+	}
+	resp, err := federationClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	doc, err := io.ReadAll(io.LimitReader(resp.Body, maxBundleSize))
+	if err != nil {
+		return nil, fmt.Errorf("read bundle: %w", err)
+	}
+	return spiffebundle.Parse(td, doc)
+}
+
+// mergeFederatedBundles overlays the fetched federated bundles onto tb,
+// replacing the on-disk entry of each trust domain that has one.
+func (s *ShimServer) mergeFederatedBundles(tb *trustBundlesFile) error {
+	s.fedMu.Lock()
+	defer s.fedMu.Unlock()
+	for domain, bundle := range s.fedBundles {
+		entry, err := trustDomainEntryFromBundle(bundle)
+		if err != nil {
+			return fmt.Errorf("federated bundle for %s: %w", domain, err)
+		}
+		tb.TrustDomains[domain] = entry
+	}
+	return nil
+}
+
+// trustDomainEntryFromBundle converts a SPIFFE bundle to the trust_bundles.json
+// entry format.
+func trustDomainEntryFromBundle(bundle *spiffebundle.Bundle) (trustDomainEntry, error) {
+	var entry trustDomainEntry
+	for _, cert := range bundle.X509Authorities() {
+		entry.Keys = append(entry.Keys, trustKey{
+			Use: "x509-svid",
+			X5C: []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+		})
+	}
+	authorities := bundle.JWTAuthorities()
+	kids := make([]string, 0, len(authorities))
+	for kid := range authorities {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		raw, err := jose.JSONWebKey{Key: authorities[kid], KeyID: kid, Use: "jwt-svid"}.MarshalJSON()
+		if err != nil {
+			return trustDomainEntry{}, fmt.Errorf("marshal jwt key %q: %w", kid, err)
+		}
+		var key trustKey
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return trustDomainEntry{}, fmt.Errorf("convert jwt key %q: %w", kid, err)
+		}
+		entry.Keys = append(entry.Keys, key)
+	}
+	seq, _ := bundle.SequenceNumber()
+	entry.SpiffeSequence = int64(seq)
+	return entry, nil
+}
@@ -0,0 +1,161 @@
+package shimserver
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// bundleEndpoint is a test SPIFFE bundle endpoint serving the bundle of
+// other.org with a single jwt-svid key "k1" and, unless it is 0, the given
+// spiffe_sequence.
+type bundleEndpoint struct {
+	mu     sync.Mutex
+	bundle *spiffebundle.Bundle
+}
+
+func (e *bundleEndpoint) set(t *testing.T, key crypto.PublicKey, seq uint64) {
+	t.Helper()
+	bundle := spiffebundle.New(spiffeid.RequireTrustDomainFromString("other.org"))
+	if err := bundle.AddJWTAuthority("k1", key); err != nil {
+		t.Fatal(err)
+	}
+	if seq != 0 {
+		bundle.SetSequenceNumber(seq)
+	}
+	e.mu.Lock()
+	e.bundle = bundle
+	e.mu.Unlock()
+}
+
+func (e *bundleEndpoint) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	e.mu.Lock()
+	doc, err := e.bundle.Marshal()
+	e.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(doc)
+}
+
+// bundleServer serves the bundle endpoints of every test. It is shared, and
+// federationClient is set once, because the federation goroutine of a closed
+// server may still be fetching when the next test starts.
+var (
+	bundleServerOnce sync.Once
+	bundleServer     *httptest.Server
+	bundleMux        = http.NewServeMux()
+	bundleEndpoints  atomic.Int64
+)
+
+// startBundleEndpoint serves e over HTTPS and returns its URL.
+func startBundleEndpoint(t *testing.T, e *bundleEndpoint) string {
+	t.Helper()
+	bundleServerOnce.Do(func() {
+		bundleServer = httptest.NewTLSServer(bundleMux)
+		federationClient = bundleServer.Client()
+	})
+	path := fmt.Sprintf("/%d", bundleEndpoints.Add(1))
+	bundleMux.Handle(path, e)
+	return bundleServer.URL + path
+}
+
+// otherJWTKeyX returns the x coordinate of the other.org key in resp.
+func otherJWTKeyX(t *testing.T, resp *workloadv1.JWTBundlesResponse) string {
+	t.Helper()
+	var jwks struct {
+		Keys []trustKey `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Bundles["spiffe://other.org"], &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("other.org has %d JWT keys, want 1", len(jwks.Keys))
+	}
+	return jwks.Keys[0].X
+}
+
+// waitForJWTKey receives JWT bundle responses until the other.org key is want.
+func waitForJWTKey(t *testing.T, r *receiver[*workloadv1.JWTBundlesResponse], want crypto.PublicKey) {
+	t.Helper()
+	wantX := jwtTrustKey(t, "k1", want).X
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if otherJWTKeyX(t, r.next(t)) == wantX {
+			return
+		}
+	}
+	t.Fatal("rotated federated JWT key was not sent")
+}
+
+func TestFederatedKeyRotationWithoutSequenceBumpIsSent(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		firstSeq, nextSeq uint64
+	}{
+		{"same sequence", 3, 3},
+		{"no sequence", 0, 0},
+		{"sequence dropped", 3, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint := &bundleEndpoint{}
+			first := newECKey(t)
+			endpoint.set(t, first.Public(), tc.firstSeq)
+			url := startBundleEndpoint(t, endpoint)
+
+			tf := newTestFiles(t)
+			_, client := startTestServer(t, Config{
+				Files:             tf.clone(),
+				Federation:        map[string]string{"other.org": url},
+				FederationRefresh: 50 * time.Millisecond,
+			})
+			stream, err := client.FetchJWTBundles(streamCtx(t), &workloadv1.JWTBundlesRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := receive(stream.Recv)
+			waitForJWTKey(t, r, first.Public())
+
+			second := newECKey(t)
+			endpoint.set(t, second.Public(), tc.nextSeq)
+			waitForJWTKey(t, r, second.Public())
+		})
+	}
+}
+
+func TestFederatedBundleWithOlderSequenceIsIgnored(t *testing.T) {
+	endpoint := &bundleEndpoint{}
+	first := newECKey(t)
+	endpoint.set(t, first.Public(), 3)
+	url := startBundleEndpoint(t, endpoint)
+
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{
+		Files:             tf.clone(),
+		Federation:        map[string]string{"other.org": url},
+		FederationRefresh: 50 * time.Millisecond,
+	})
+	stream, err := client.FetchJWTBundles(streamCtx(t), &workloadv1.JWTBundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := receive(stream.Recv)
+	waitForJWTKey(t, r, first.Public())
+
+	endpoint.set(t, newECKey(t).Public(), 2)
+	r.none(t, 300*time.Millisecond)
+	if got, want := otherJWTKeyX(t, shim.jwtBundles.Load()), jwtTrustKey(t, "k1", first.Public()).X; got != want {
+		t.Fatal("a federated bundle with an older spiffe_sequence replaced the served one")
+	}
+}
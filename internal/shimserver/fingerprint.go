@@ -0,0 +1,49 @@
+package shimserver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+)
+
+// fingerprint returns a SHA-256 over the paths and contents of the watched
+// credential files, or "" when one of them cannot be read. Files that do not
+// exist are left out, so creating or removing one changes the fingerprint.
+func (s *ShimServer) fingerprint() string {
+	paths := slices.DeleteFunc(s.watchedFiles(), func(path string) bool {
+		return slices.Contains(s.lockPaths, path)
+	})
+	slices.Sort(paths)
+	h := sha256.New()
+	for _, path := range paths {
+		data, err := readFileTimeout(path, s.readTimeout)
+		if err != nil {
+			return ""
+		}
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(data))))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// rotateIfChanged is rotate for the watcher and the poller: it skips the
+// rotation when the credential files hold what the last applied rotation
+// read, as after a touch or a rewrite with the same content, so that such
+// events log no rotation and trigger neither the file output nor the
+// notifiers. A degraded server always rotates, so that a failed rebuild is
+// retried. The fingerprint is only recorded after a successful rebuild.
+func (s *ShimServer) rotateIfChanged() {
+	fp := s.fingerprint()
+	if fp != "" && fp == s.appliedFingerprint && !s.degraded.Load() {
+		slog.Debug("credential watcher: credential files unchanged, skipping rotation")
+		return
+	}
+	s.rotate()
+	if !s.degraded.Load() {
+		s.appliedFingerprint = fp
+	}
+}
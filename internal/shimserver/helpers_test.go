@@ -0,0 +1,355 @@
+package shimserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testSPIFFEID is the SPIFFE ID of the leaf certificates of newTestFiles.
+const testSPIFFEID = "spiffe://example.org/workload"
+
+// testCA is a self-signed CA issuing the leaf certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key := newECKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pemBlock("CERTIFICATE", der)}
+}
+
+// issue returns a leaf certificate for uri, signed by ca for a new P-256 key,
+// and the key, both as PEM. Each opt may adjust the certificate template.
+func (ca *testCA) issue(t testing.TB, uri string, opts ...func(*x509.Certificate)) (certPEM, keyPEM []byte) {
+	t.Helper()
+	return ca.issueFor(t, uri, newECKey(t), opts...)
+}
+
+// issueFor is issue for a given leaf key.
+func (ca *testCA) issueFor(t testing.TB, uri string, key crypto.Signer, opts ...func(*x509.Certificate)) (certPEM, keyPEM []byte) {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = []*url.URL{u}
+	}
+	for _, opt := range opts {
+		opt(tmpl)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pemBlock("CERTIFICATE", der), pemBlock("PRIVATE KEY", keyDER)
+}
+
+// intermediate returns an intermediate CA signed by ca.
+func (ca *testCA) intermediate(t testing.TB) *testCA {
+	t.Helper()
+	key := newECKey(t)
+	certPEM, _ := ca.issueFor(t, "", key, func(c *x509.Certificate) {
+		c.Subject = pkix.Name{CommonName: "test intermediate CA"}
+		c.IsCA, c.BasicConstraintsValid = true, true
+		c.KeyUsage = x509.KeyUsageCertSign
+	})
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: certPEM}
+}
+
+func newECKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func pemBlock(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
+
+// x509TrustKey returns the trust_bundles.json key of an x509-svid authority.
+func x509TrustKey(cert *x509.Certificate) trustKey {
+	return trustKey{Use: "x509-svid", Kty: "EC", Crv: "P-256", X5C: []string{base64.StdEncoding.EncodeToString(cert.Raw)}}
+}
+
+// jwtTrustKey returns the trust_bundles.json key of a jwt-svid authority.
+func jwtTrustKey(t testing.TB, kid string, pub crypto.PublicKey) trustKey {
+	t.Helper()
+	raw, err := jose.JSONWebKey{Key: pub, KeyID: kid, Use: "jwt-svid"}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key trustKey
+	if err := json.Unmarshal(raw, &key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// trustBundlesJSON encodes domains as a trust_bundles.json document.
+func trustBundlesJSON(t testing.TB, domains map[string]trustDomainEntry) []byte {
+	t.Helper()
+	data, err := json.Marshal(trustBundlesFile{TrustDomains: domains})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testFiles is a complete set of in-memory credential files: a leaf for
+// testSPIFFEID issued by ca, and a trust_bundles.json with the local trust
+// domain example.org and the federated domain other.org, whose jwt-svid key
+// "k1" is other.
+type testFiles struct {
+	ca    *testCA
+	other *ecdsa.PrivateKey
+	files map[string][]byte
+}
+
+func newTestFiles(t testing.TB) *testFiles {
+	t.Helper()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, testSPIFFEID)
+	tf := &testFiles{ca: ca, other: newECKey(t), files: map[string][]byte{
+		"certificates.pem":    certPEM,
+		"private_key.pem":     keyPEM,
+		"ca_certificates.pem": ca.pem,
+	}}
+	tf.setBundles(t, 1, 1)
+	return tf
+}
+
+// setBundles writes trust_bundles.json with the given spiffe_sequence of
+// example.org and other.org.
+func (tf *testFiles) setBundles(t testing.TB, localSeq, otherSeq int64) {
+	t.Helper()
+	tf.files["trust_bundles.json"] = trustBundlesJSON(t, map[string]trustDomainEntry{
+		"example.org": {SpiffeSequence: localSeq, Keys: []trustKey{x509TrustKey(tf.ca.cert)}},
+		"other.org": {SpiffeSequence: otherSeq, Keys: []trustKey{
+			x509TrustKey(tf.ca.cert),
+			jwtTrustKey(t, "k1", tf.other.Public()),
+		}},
+	})
+}
+
+// setJWTKey makes key the JWT signing key.
+func (tf *testFiles) setJWTKey(t testing.TB, key crypto.Signer) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.files[jwtSigningKeyFile] = pemBlock("PRIVATE KEY", der)
+}
+
+// clone returns a copy of the files, for SetFiles.
+func (tf *testFiles) clone() map[string][]byte {
+	files := make(map[string][]byte, len(tf.files))
+	for name, data := range tf.files {
+		files[name] = data
+	}
+	return files
+}
+
+// startTestServer creates a ShimServer from cfg and serves it over an
+// in-memory listener, returning it with a client connected to it. Both are
+// stopped when the test ends.
+func startTestServer(t testing.TB, cfg Config) (*ShimServer, workloadv1.SpiffeWorkloadAPIClient) {
+	t.Helper()
+	shim, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	workloadv1.RegisterSpiffeWorkloadAPIServer(srv, shim)
+	go srv.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		shim.Close()
+		srv.Stop()
+	})
+	return shim, workloadv1.NewSpiffeWorkloadAPIClient(conn)
+}
+
+// streamCtx returns a context for a stream that is cancelled when the test
+// ends.
+func streamCtx(t testing.TB) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// receiver delivers the messages of a stream on a channel, so that tests can
+// wait for one with a timeout.
+type receiver[T any] struct {
+	msgs chan T
+	errs chan error
+}
+
+func receive[T any](recv func() (T, error)) *receiver[T] {
+	r := &receiver[T]{msgs: make(chan T, 16), errs: make(chan error, 1)}
+	go func() {
+		for {
+			m, err := recv()
+			if err != nil {
+				r.errs <- err
+				return
+			}
+			r.msgs <- m
+		}
+	}()
+	return r
+}
+
+// next returns the next message, failing the test if none arrives within 5s.
+func (r *receiver[T]) next(t testing.TB) T {
+	t.Helper()
+	select {
+	case m := <-r.msgs:
+		return m
+	case err := <-r.errs:
+		t.Fatalf("stream failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received within 5s")
+	}
+	panic("unreachable")
+}
+
+// none fails the test if a message arrives within d.
+func (r *receiver[T]) none(t testing.TB, d time.Duration) {
+	t.Helper()
+	select {
+	case m := <-r.msgs:
+		t.Fatalf("unexpected message: %v", m)
+	case err := <-r.errs:
+		t.Fatalf("stream failed: %v", err)
+	case <-time.After(d):
+	}
+}
+
+// err returns the error that ended the stream, failing the test if it does
+// not end within 5s.
+func (r *receiver[T]) err(t testing.TB) error {
+	t.Helper()
+	select {
+	case m := <-r.msgs:
+		t.Fatalf("unexpected message: %v", m)
+	case err := <-r.errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not end within 5s")
+	}
+	return nil
+}
+
+// fetchX509SVID returns the first response of a FetchX509SVID stream.
+func fetchX509SVID(t testing.TB, client workloadv1.SpiffeWorkloadAPIClient) *workloadv1.X509SVIDResponse {
+	t.Helper()
+	stream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// fetchX509Bundles returns the first response of a FetchX509Bundles stream.
+func fetchX509Bundles(t testing.TB, client workloadv1.SpiffeWorkloadAPIClient) *workloadv1.X509BundlesResponse {
+	t.Helper()
+	stream, err := client.FetchX509Bundles(streamCtx(t), &workloadv1.X509BundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// fetchJWTBundles returns the first response of a FetchJWTBundles stream.
+func fetchJWTBundles(t testing.TB, client workloadv1.SpiffeWorkloadAPIClient) *workloadv1.JWTBundlesResponse {
+	t.Helper()
+	stream, err := client.FetchJWTBundles(streamCtx(t), &workloadv1.JWTBundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,300 @@
+package shimserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// jwtSVIDAlgorithms are the signature algorithms accepted by ValidateJWTSVID.
+var jwtSVIDAlgorithms = []jose.SignatureAlgorithm{
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+const jwtSigningKeyFile = "jwt_signing_key.pem"
+
+// jwtSigner holds the key used to mint JWT-SVIDs and its JOSE parameters.
+type jwtSigner struct {
+	key crypto.Signer
+	alg jose.SignatureAlgorithm
+	kid string
+}
+
+// loadJWTSigner reads jwt_signing_key.pem and resolves the signing algorithm
+// and key ID. It returns an error wrapping os.ErrNotExist when no key is present.
+//
+// Nothing about the key is cached: it is loaded again for every minted
+// JWT-SVID and every rebuild, so a rotation to a key of another type, such
+// as from EC to RSA, changes the algorithm and the thumbprint key ID at once.
+func (s *ShimServer) loadJWTSigner() (*jwtSigner, error) {
+	keyDER, err := s.loadPrivateKeyPKCS8DER(jwtSigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", jwtSigningKeyFile, err)
+	}
+	signer, alg, err := jwtSigningAlgorithm(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", jwtSigningKeyFile, err)
+	}
+	kid := s.jwtKeyID
+	if kid == "" {
+		jwk := jose.JSONWebKey{Key: signer.Public()}
+		tp, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("compute JWT signing key thumbprint: %w", err)
+		}
+		kid = base64.RawURLEncoding.EncodeToString(tp)
+	}
+	return &jwtSigner{key: signer, alg: alg, kid: kid}, nil
+}
+
+// jwtSigningAlgorithm returns the JOSE algorithm used to sign with key:
+// ES256/ES384/ES512 by EC curve, RS256 for RSA and EdDSA for Ed25519.
+func jwtSigningAlgorithm(key any) (crypto.Signer, jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return k, jose.ES256, nil
+		case elliptic.P384():
+			return k, jose.ES384, nil
+		case elliptic.P521():
+			return k, jose.ES512, nil
+		}
+		return nil, "", fmt.Errorf("unsupported EC curve %s", k.Curve.Params().Name)
+	case *rsa.PrivateKey:
+		return k, jose.RS256, nil
+	case ed25519.PrivateKey:
+		return k, jose.EdDSA, nil
+	}
+	return nil, "", fmt.Errorf("unsupported JWT signing key type %T", key)
+}
+
+// mintJWTSVID signs a JWT-SVID for spiffeID valid for the given audiences.
+func (s *ShimServer) mintJWTSVID(signer *jwtSigner, spiffeID string, audience []string) (string, error) {
+	opts := (&jose.SignerOptions{}).WithType("JWT").WithHeader(jose.HeaderKey("kid"), signer.kid)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: signer.alg, Key: signer.key}, opts)
+	if err != nil {
+		return "", fmt.Errorf("create JWT signer: %w", err)
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Subject:  spiffeID,
+		Audience: jwt.Audience(audience),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(s.jwtTTL)),
+	}
+	return jwt.Signed(sig).Claims(claims).Serialize()
+}
+
+// localSPIFFEIDs returns the SPIFFE IDs of the identities served by this shim.
+func (s *ShimServer) localSPIFFEIDs() ([]string, error) {
+	resp, err := s.x509SVIDResponse()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(resp.Svids))
+	for _, svid := range resp.Svids {
+		ids = append(ids, svid.SpiffeId)
+	}
+	return ids, nil
+}
+
+// FetchJWTSVID mints a JWT-SVID for each local identity, or only the one named
+// by the request's spiffe_id, signed with the key in jwt_signing_key.pem.
+func (s *ShimServer) FetchJWTSVID(_ context.Context, req *workloadv1.JWTSVIDRequest) (*workloadv1.JWTSVIDResponse, error) {
+	if s.draining.Load() {
+		return nil, drainingError()
+	}
+	if len(req.Audience) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+	for _, aud := range req.Audience {
+		if aud == "" {
+			return nil, status.Error(codes.InvalidArgument, "audience must not contain empty values")
+		}
+	}
+	signer, err := s.loadJWTSigner()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.Unimplemented, "JWT SVIDs are not available: %s is not present", jwtSigningKeyFile)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	ids, err := s.localSPIFFEIDs()
+	if err != nil {
+		return nil, credentialError(err)
+	}
+	if req.SpiffeId != "" {
+		found := false
+		for _, id := range ids {
+			if id == req.SpiffeId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown SPIFFE ID %q", req.SpiffeId)
+		}
+		ids = []string{req.SpiffeId}
+	}
+
+	resp := &workloadv1.JWTSVIDResponse{}
+	for _, id := range ids {
+		token, err := s.mintJWTSVID(signer, id, req.Audience)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "%v", err)
+		}
+		resp.Svids = append(resp.Svids, &workloadv1.JWTSVID{SpiffeId: id, Svid: token})
+	}
+	return resp, nil
+}
+
+// jwtKeySet returns the JWKS for trustDomain built from trust_bundles.json,
+// and false if the trust domain has no JWT bundle.
+func (s *ShimServer) jwtKeySet(trustDomain spiffeid.TrustDomain) (*jose.JSONWebKeySet, bool, error) {
+	resp, err := s.jwtBundlesResponse()
+	if err != nil {
+		return nil, false, err
+	}
+	raw, ok := resp.Bundles[trustDomain.IDString()]
+	if !ok {
+		return nil, false, nil
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, false, fmt.Errorf("parse JWT bundle for %s: %w", trustDomain, err)
+	}
+	return &set, true, nil
+}
+
+// jwtKeySetContext is jwtKeySet bounded by ctx. The key set is normally
+// cached, but before the first successful rebuild it is read from disk, which
+// can be slow; a caller whose deadline passes meanwhile gets the context
+// error instead of waiting.
+func (s *ShimServer) jwtKeySetContext(ctx context.Context, trustDomain spiffeid.TrustDomain) (*jose.JSONWebKeySet, bool, error) {
+	type result struct {
+		set *jose.JSONWebKeySet
+		ok  bool
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		set, ok, err := s.jwtKeySet(trustDomain)
+		done <- result{set, ok, err}
+	}()
+	select {
+	case r := <-done:
+		return r.set, r.ok, r.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// ValidateJWTSVID verifies a JWT-SVID against the JWT bundle of the trust
+// domain named by its subject and returns the token's claims. It gives up
+// with DeadlineExceeded or Canceled once the caller's context ends. A rejected
+// token's error carries an ErrorInfo detail whose reason, one of the
+// ReasonJWT constants, says why.
+func (s *ShimServer) ValidateJWTSVID(ctx context.Context, req *workloadv1.ValidateJWTSVIDRequest) (*workloadv1.ValidateJWTSVIDResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	if req.Audience == "" {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+	if req.Svid == "" {
+		return nil, status.Error(codes.InvalidArgument, "svid must be specified")
+	}
+	tok, err := jwt.ParseSigned(req.Svid, jwtSVIDAlgorithms)
+	if err != nil {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTMalformed, fmt.Sprintf("parse JWT-SVID: %v", err))
+	}
+	kid := tok.Headers[0].KeyID
+	if kid == "" {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTMalformed, "JWT-SVID header has no key ID")
+	}
+	var unverified jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTMalformed, fmt.Sprintf("decode JWT-SVID claims: %v", err))
+	}
+	id, err := spiffeid.FromString(unverified.Subject)
+	if err != nil {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTMalformed, fmt.Sprintf("JWT-SVID subject is not a SPIFFE ID: %v", err))
+	}
+
+	set, ok, err := s.jwtKeySetContext(ctx, id.TrustDomain())
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, status.FromContextError(ctxErr).Err()
+	}
+	if err != nil {
+		return nil, credentialError(err)
+	}
+	if !ok {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTUnknownTrustDomain,
+			fmt.Sprintf("no JWT bundle for trust domain %q", id.TrustDomain()), "trust_domain", id.TrustDomain().Name())
+	}
+	keys := set.Key(kid)
+	if len(keys) == 0 {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTUnknownKey,
+			fmt.Sprintf("key %q not found in JWT bundle for trust domain %q", kid, id.TrustDomain()),
+			"trust_domain", id.TrustDomain().Name(), "kid", kid)
+	}
+
+	var claims jwt.Claims
+	var raw map[string]interface{}
+	if err := tok.Claims(keys[0].Key, &claims, &raw); err != nil {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTBadSignature,
+			fmt.Sprintf("verify JWT-SVID signature: %v", err), "kid", kid)
+	}
+	if claims.Expiry == nil {
+		return nil, jwtValidationError(codes.InvalidArgument, ReasonJWTNoExpiry, "JWT-SVID has no expiry")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, 0); err != nil {
+		reason := ReasonJWTMalformed
+		switch {
+		case errors.Is(err, jwt.ErrExpired):
+			reason = ReasonJWTExpired
+		case errors.Is(err, jwt.ErrNotValidYet), errors.Is(err, jwt.ErrIssuedInTheFuture):
+			reason = ReasonJWTNotYetValid
+		}
+		return nil, jwtValidationError(codes.InvalidArgument, reason, fmt.Sprintf("JWT-SVID is not valid: %v", err))
+	}
+	if !claims.Audience.Contains(req.Audience) {
+		return nil, jwtValidationError(codes.PermissionDenied, ReasonJWTAudienceMismatch,
+			fmt.Sprintf("JWT-SVID audience does not include %q", req.Audience), "audience", req.Audience)
+	}
+
+	claimsStruct, err := structpb.NewStruct(raw)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "convert JWT-SVID claims: %v", err)
+	}
+	return &workloadv1.ValidateJWTSVIDResponse{
+		SpiffeId: id.String(),
+		Claims:   claimsStruct,
+	}, nil
+}
@@ -0,0 +1,195 @@
+package shimserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// localJWKS returns the JWT bundle of the local trust domain.
+func localJWKS(t *testing.T, client workloadv1.SpiffeWorkloadAPIClient) jose.JSONWebKeySet {
+	t.Helper()
+	stream, err := client.FetchJWTBundles(streamCtx(t), &workloadv1.JWTBundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(resp.Bundles["spiffe://example.org"], &set); err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestJWTSVIDSigningAlgorithms(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		key   crypto.Signer
+		alg   jose.SignatureAlgorithm
+		keyID string
+	}{
+		{"p256", newECKey(t), jose.ES256, ""},
+		{"p384", p384, jose.ES384, ""},
+		{"p521", p521, jose.ES512, ""},
+		{"rsa", newRSAKey(t), jose.RS256, ""},
+		{"ed25519", edKey, jose.EdDSA, ""},
+		{"configured kid", newECKey(t), jose.ES256, "my-key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf := newTestFiles(t)
+			tf.setJWTKey(t, tc.key)
+			_, client := startTestServer(t, Config{
+				Files:                 tf.clone(),
+				IncludeLocalJWTBundle: true,
+				JWTTTL:                time.Minute,
+				JWTKeyID:              tc.keyID,
+			})
+			resp, err := client.FetchJWTSVID(context.Background(), &workloadv1.JWTSVIDRequest{Audience: []string{"aud"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, err := jwt.ParseSigned(resp.Svids[0].Svid, jwtSVIDAlgorithms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := tok.Headers[0]
+			if header.Algorithm != string(tc.alg) {
+				t.Errorf("alg = %s, want %s", header.Algorithm, tc.alg)
+			}
+			if want := tc.keyID; want != "" && header.KeyID != want {
+				t.Errorf("kid = %q, want %q", header.KeyID, want)
+			}
+
+			set := localJWKS(t, client)
+			keys := set.Key(header.KeyID)
+			if len(keys) != 1 {
+				t.Fatalf("local JWT bundle has %d keys with kid %q, want 1", len(keys), header.KeyID)
+			}
+			var claims jwt.Claims
+			if err := tok.Claims(keys[0].Key, &claims); err != nil {
+				t.Fatalf("verify with the JWT bundle key: %v", err)
+			}
+			if claims.Subject != testSPIFFEID {
+				t.Errorf("sub = %q, want %q", claims.Subject, testSPIFFEID)
+			}
+		})
+	}
+}
+
+func TestFetchJWTSVIDRequestValidation(t *testing.T) {
+	tf := newTestFiles(t)
+	cert, key := tf.ca.issue(t, "spiffe://example.org/other")
+	tf.files["certificates-1.pem"], tf.files["private_key-1.pem"] = cert, key
+	tf.setJWTKey(t, newECKey(t))
+	_, client := startTestServer(t, Config{Files: tf.clone(), JWTTTL: time.Minute})
+
+	for _, tc := range []struct {
+		name string
+		req  *workloadv1.JWTSVIDRequest
+		code codes.Code
+		ids  []string
+	}{
+		{"no audience", &workloadv1.JWTSVIDRequest{}, codes.InvalidArgument, nil},
+		{"empty audience", &workloadv1.JWTSVIDRequest{Audience: []string{"aud", ""}}, codes.InvalidArgument, nil},
+		{"unknown spiffe_id", &workloadv1.JWTSVIDRequest{Audience: []string{"aud"}, SpiffeId: "spiffe://example.org/unknown"}, codes.InvalidArgument, nil},
+		{"every identity", &workloadv1.JWTSVIDRequest{Audience: []string{"aud"}}, codes.OK, []string{testSPIFFEID, "spiffe://example.org/other"}},
+		{"one identity", &workloadv1.JWTSVIDRequest{Audience: []string{"aud"}, SpiffeId: "spiffe://example.org/other"}, codes.OK, []string{"spiffe://example.org/other"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.FetchJWTSVID(context.Background(), tc.req)
+			if status.Code(err) != tc.code {
+				t.Fatalf("FetchJWTSVID error = %v, want code %v", err, tc.code)
+			}
+			var ids []string
+			for _, svid := range resp.GetSvids() {
+				ids = append(ids, svid.SpiffeId)
+			}
+			if !slices.Equal(ids, tc.ids) {
+				t.Fatalf("JWT-SVIDs for %v, want %v", ids, tc.ids)
+			}
+		})
+	}
+}
+
+func TestValidateJWTSVIDHonorsContext(t *testing.T) {
+	tf := newTestFiles(t)
+	tf.files["trust_bundles.json"] = []byte("{")
+	// The handler is called directly: through a client, gRPC would end the
+	// call at the deadline whatever the handler does.
+	shim, _ := startTestServer(t, Config{Files: tf.clone()})
+	// No JWT bundles are cached, so validation reads the trust bundles from
+	// the source, which blocks.
+	gate := &gatedSource{credSource: shim.creds, entered: make(chan struct{}), release: make(chan struct{})}
+	shim.creds = gate
+	t.Cleanup(func() { close(gate.release) })
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: newECKey(t)},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader(jose.HeaderKey("kid"), "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(jwt.Claims{Subject: "spiffe://other.org/workload", Audience: jwt.Audience{"aud"}}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &workloadv1.ValidateJWTSVIDRequest{Audience: "aud", Svid: token}
+	validate := func(ctx context.Context) error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := shim.ValidateJWTSVID(ctx, req)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatal("ValidateJWTSVID is still blocked 2s after the call")
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := validate(ctx); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("ValidateJWTSVID error = %v, want DeadlineExceeded", err)
+	}
+	select {
+	case <-gate.entered:
+	default:
+		t.Fatal("validation did not reach the trust bundles read")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := validate(ctx); status.Code(err) != codes.Canceled {
+		t.Fatalf("ValidateJWTSVID error = %v, want Canceled", err)
+	}
+}
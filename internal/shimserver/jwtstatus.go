@@ -0,0 +1,52 @@
+package shimserver
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// JWTErrorDomain is the domain of the ErrorInfo detail attached to the
+// errors of ValidateJWTSVID.
+const JWTErrorDomain = "workload-api-shim"
+
+// The reasons of the ErrorInfo detail of ValidateJWTSVID errors, so that
+// clients can tell why a token was rejected without parsing the message.
+const (
+	// ReasonJWTMalformed: the token or its claims do not parse, its header
+	// has no key ID or its subject is not a SPIFFE ID.
+	ReasonJWTMalformed = "JWT_SVID_MALFORMED"
+	// ReasonJWTUnknownTrustDomain: no JWT bundle is served for the trust
+	// domain of the subject.
+	ReasonJWTUnknownTrustDomain = "JWT_SVID_UNKNOWN_TRUST_DOMAIN"
+	// ReasonJWTUnknownKey: the JWT bundle has no key with the token's key ID.
+	ReasonJWTUnknownKey = "JWT_SVID_UNKNOWN_KEY"
+	// ReasonJWTBadSignature: the signature does not verify with the key.
+	ReasonJWTBadSignature = "JWT_SVID_BAD_SIGNATURE"
+	// ReasonJWTNoExpiry: the token has no exp claim.
+	ReasonJWTNoExpiry = "JWT_SVID_NO_EXPIRY"
+	// ReasonJWTExpired: the token's exp is in the past.
+	ReasonJWTExpired = "JWT_SVID_EXPIRED"
+	// ReasonJWTNotYetValid: the token's nbf or iat is in the future.
+	ReasonJWTNotYetValid = "JWT_SVID_NOT_YET_VALID"
+	// ReasonJWTAudienceMismatch: the token's aud does not include the
+	// requested audience.
+	ReasonJWTAudienceMismatch = "JWT_SVID_AUDIENCE_MISMATCH"
+)
+
+// jwtValidationError returns a status error with code and msg carrying an
+// ErrorInfo detail with reason and the given metadata key/value pairs.
+func jwtValidationError(code codes.Code, reason, msg string, kv ...string) error {
+	info := &errdetails.ErrorInfo{Reason: reason, Domain: JWTErrorDomain}
+	if len(kv) > 0 {
+		info.Metadata = make(map[string]string, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			info.Metadata[kv[i]] = kv[i+1]
+		}
+	}
+	st, err := status.New(code, msg).WithDetails(info)
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
@@ -0,0 +1,122 @@
+package shimserver
+
+import (
+	"context"
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// signJWT signs claims with key, with kid as the key ID header unless empty.
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims jwt.Claims) string {
+	t.Helper()
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// errorReason returns the reason of the ErrorInfo detail of err.
+func errorReason(t *testing.T, err error) string {
+	t.Helper()
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			if info.Domain != JWTErrorDomain {
+				t.Errorf("ErrorInfo domain = %q, want %q", info.Domain, JWTErrorDomain)
+			}
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestValidateJWTSVIDErrors(t *testing.T) {
+	tf := newTestFiles(t)
+	local := newECKey(t)
+	tf.setJWTKey(t, local)
+	_, client := startTestServer(t, Config{
+		Files:                 tf.clone(),
+		IncludeLocalJWTBundle: true,
+		JWTTTL:                time.Minute,
+		JWTKeyID:              "local",
+	})
+
+	now := time.Now()
+	valid := jwt.Claims{
+		Subject:  testSPIFFEID,
+		Audience: jwt.Audience{"aud"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+	}
+	with := func(f func(c *jwt.Claims)) jwt.Claims {
+		c := valid
+		f(&c)
+		return c
+	}
+	for _, tc := range []struct {
+		name   string
+		token  string
+		code   codes.Code
+		reason string
+	}{
+		{"not a JWT", "abc", codes.InvalidArgument, ReasonJWTMalformed},
+		{"no key ID", signJWT(t, local, "", valid), codes.InvalidArgument, ReasonJWTMalformed},
+		{"subject not a SPIFFE ID", signJWT(t, local, "local", with(func(c *jwt.Claims) { c.Subject = "workload" })), codes.InvalidArgument, ReasonJWTMalformed},
+		{"unknown trust domain", signJWT(t, local, "local", with(func(c *jwt.Claims) { c.Subject = "spiffe://nowhere.org/w" })), codes.InvalidArgument, ReasonJWTUnknownTrustDomain},
+		{"unknown key", signJWT(t, local, "other", valid), codes.InvalidArgument, ReasonJWTUnknownKey},
+		{"bad signature", signJWT(t, newECKey(t), "local", valid), codes.InvalidArgument, ReasonJWTBadSignature},
+		{"no expiry", signJWT(t, local, "local", with(func(c *jwt.Claims) { c.Expiry = nil })), codes.InvalidArgument, ReasonJWTNoExpiry},
+		{"expired", signJWT(t, local, "local", with(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(now.Add(-time.Minute)) })), codes.InvalidArgument, ReasonJWTExpired},
+		{"not yet valid", signJWT(t, local, "local", with(func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) })), codes.InvalidArgument, ReasonJWTNotYetValid},
+		{"audience mismatch", signJWT(t, local, "local", with(func(c *jwt.Claims) { c.Audience = jwt.Audience{"other"} })), codes.PermissionDenied, ReasonJWTAudienceMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.ValidateJWTSVID(context.Background(), &workloadv1.ValidateJWTSVIDRequest{Audience: "aud", Svid: tc.token})
+			if status.Code(err) != tc.code {
+				t.Fatalf("ValidateJWTSVID error = %v, want code %v", err, tc.code)
+			}
+			if got := errorReason(t, err); got != tc.reason {
+				t.Fatalf("ErrorInfo reason = %q, want %q", got, tc.reason)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		minted, err := client.FetchJWTSVID(context.Background(), &workloadv1.JWTSVIDRequest{Audience: []string{"aud", "other"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.ValidateJWTSVID(context.Background(), &workloadv1.ValidateJWTSVIDRequest{Audience: "aud", Svid: minted.Svids[0].Svid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.SpiffeId != testSPIFFEID {
+			t.Errorf("spiffe_id = %q, want %q", resp.SpiffeId, testSPIFFEID)
+		}
+		claims := resp.Claims.AsMap()
+		if claims["sub"] != testSPIFFEID {
+			t.Errorf("sub claim = %v, want %q", claims["sub"], testSPIFFEID)
+		}
+		if aud, _ := claims["aud"].([]any); len(aud) != 2 || aud[0] != "aud" || aud[1] != "other" {
+			t.Errorf("aud claim = %v, want [aud other]", claims["aud"])
+		}
+		if _, ok := claims["exp"].(float64); !ok {
+			t.Errorf("exp claim = %v, want a number", claims["exp"])
+		}
+	})
+}
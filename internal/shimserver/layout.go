@@ -0,0 +1,144 @@
+package shimserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+)
+
+// credsLayout holds the default basenames of the leaf certificate chain, its
+// private key and the local CA certificates for one provider convention.
+type credsLayout struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// credsLayouts maps the names accepted by Config.CredsLayout to their default
+// file names. The sds-json layout keeps the spiffe-helper names, which are
+// then served from the SDS document rather than read from disk.
+var credsLayouts = map[string]credsLayout{
+	"spiffe-helper": {certFile: "certificates.pem", keyFile: "private_key.pem", caFile: "ca_certificates.pem"},
+	"k8s-tls":       {certFile: "tls.crt", keyFile: "tls.key", caFile: "ca.crt"},
+	"sds-json":      {certFile: "certificates.pem", keyFile: "private_key.pem", caFile: "ca_certificates.pem"},
+}
+
+// sdsDocument is the subset of an Envoy SDS file (a DiscoveryResponse of
+// envoy.extensions.transport_sockets.tls.v3.Secret resources) that the shim
+// reads.
+type sdsDocument struct {
+	Resources []struct {
+		Name           string `json:"name"`
+		TLSCertificate *struct {
+			CertificateChain sdsDataSource `json:"certificate_chain"`
+			PrivateKey       sdsDataSource `json:"private_key"`
+		} `json:"tls_certificate"`
+		ValidationContext *struct {
+			TrustedCA sdsDataSource `json:"trusted_ca"`
+		} `json:"validation_context"`
+	} `json:"resources"`
+}
+
+// sdsDataSource is an Envoy DataSource. Only inline values are supported;
+// inline_bytes is base64 in JSON and decoded by encoding/json.
+type sdsDataSource struct {
+	InlineString string `json:"inline_string"`
+	InlineBytes  []byte `json:"inline_bytes"`
+}
+
+func (d sdsDataSource) data() []byte {
+	if d.InlineString != "" {
+		return []byte(d.InlineString)
+	}
+	return d.InlineBytes
+}
+
+// sdsSource serves the leaf certificate chain, private key and local CA
+// certificates from a single SDS JSON document, under the configured
+// basenames, so the load functions need not know about the layout. Every
+// other file is read from the wrapped source.
+type sdsSource struct {
+	credSource
+	file     string
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// baseSource returns the source the credential files are read from, below
+// any layout or static files wrapper.
+func (s *ShimServer) baseSource() credSource {
+	src := s.creds
+	for {
+		switch w := src.(type) {
+		case *sdsSource:
+			src = w.credSource
+		case *staticSource:
+			src = w.credSource
+		default:
+			return src
+		}
+	}
+}
+
+// extract returns the PEM data stored in the SDS document for name, and
+// whether name is one of the files the document provides. The first
+// tls_certificate and the first validation_context resources are used.
+func (s *sdsSource) extract(name string) ([]byte, bool, error) {
+	if name != s.certFile && name != s.keyFile && name != s.caFile {
+		return nil, false, nil
+	}
+	raw, err := s.credSource.read(s.file)
+	if err != nil {
+		return nil, true, err
+	}
+	var doc sdsDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, true, fmt.Errorf("parse %s: %w", s.file, err)
+	}
+	for _, res := range doc.Resources {
+		var data []byte
+		switch {
+		case name == s.caFile && res.ValidationContext != nil:
+			data = res.ValidationContext.TrustedCA.data()
+		case name == s.certFile && res.TLSCertificate != nil:
+			data = res.TLSCertificate.CertificateChain.data()
+		case name == s.keyFile && res.TLSCertificate != nil:
+			data = res.TLSCertificate.PrivateKey.data()
+		default:
+			continue
+		}
+		if len(data) == 0 {
+			return nil, true, fmt.Errorf("%s: secret %q has no inline data for %s", s.file, res.Name, name)
+		}
+		return data, true, nil
+	}
+	return nil, true, &fs.PathError{Op: "open", Path: s.file + "#" + name, Err: fs.ErrNotExist}
+}
+
+func (s *sdsSource) read(name string) ([]byte, error) {
+	data, ok, err := s.extract(name)
+	if !ok {
+		return s.credSource.read(name)
+	}
+	return data, err
+}
+
+func (s *sdsSource) readAll(name string) ([]credFile, error) {
+	data, ok, err := s.extract(name)
+	if !ok {
+		return s.credSource.readAll(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []credFile{{path: s.file + "#" + name, data: data}}, nil
+}
+
+func (s *sdsSource) exists(name string) bool {
+	_, ok, err := s.extract(name)
+	if !ok {
+		return s.credSource.exists(name)
+	}
+	return err == nil
+}
@@ -0,0 +1,45 @@
+package shimserver
+
+import (
+	"path/filepath"
+)
+
+// lockFilePaths returns the paths at which the lock file is looked for: the
+// lock file itself when its path is absolute, otherwise its name in each
+// credentials directory.
+func lockFilePaths(lockFile string, credsDirs []string) []string {
+	if lockFile == "" {
+		return nil
+	}
+	if filepath.IsAbs(lockFile) {
+		return []string{filepath.Clean(lockFile)}
+	}
+	paths := make([]string, 0, len(credsDirs))
+	for _, dir := range credsDirs {
+		paths = append(paths, filepath.Join(filepath.Clean(dir), lockFile))
+	}
+	return paths
+}
+
+// lockedBy returns the path of a lock file that exists, or "" when the
+// credential writer holds no lock.
+func (s *ShimServer) lockedBy() string {
+	for _, path := range s.lockPaths {
+		if _, err := lstatTimeout(path, s.readTimeout); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// existingLockPaths returns the lock file paths that exist, for watching by
+// path.
+func (s *ShimServer) existingLockPaths() []string {
+	var paths []string
+	for _, path := range s.lockPaths {
+		if _, err := lstatTimeout(path, s.readTimeout); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
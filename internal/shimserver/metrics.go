@@ -0,0 +1,57 @@
+package shimserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rotationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shim_rotations_total",
+		Help: "Number of credential rotations pushed to connected streams.",
+	})
+	rebuildErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shim_rebuild_errors_total",
+		Help: "Number of failed response rebuilds after a rotation, by response type.",
+	}, []string{"response"})
+	rebuildRetriesExhaustedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shim_rebuild_retries_exhausted_total",
+		Help: "Number of rotations whose rebuild still failed after all retries.",
+	})
+	svidExpirySeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shim_svid_expiry_seconds",
+		Help: "Seconds until the served leaf certificate expires (negative once expired), by SPIFFE ID.",
+	}, []string{"spiffe_id"})
+	bundleSequence = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shim_bundle_sequence",
+		Help: "spiffe_sequence of each trust domain in trust_bundles.json at the last rebuild.",
+	}, []string{"trust_domain"})
+	bundleDomainErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shim_bundle_domain_errors_total",
+		Help: "Number of times a federated trust domain was left out of the X.509 bundles for malformed keys, by trust domain.",
+	}, []string{"trust_domain"})
+	federationFetchErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shim_federation_fetch_errors_total",
+		Help: "Number of failed federated bundle fetches, by trust domain.",
+	}, []string{"trust_domain"})
+	streamSendErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shim_stream_send_errors_total",
+		Help: "Number of failed stream sends, by Workload API method.",
+	}, []string{"method"})
+	broadcastDropsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shim_broadcast_drops_total",
+		Help: "Number of rotation signals not queued because the stream had not consumed the previous one, by broadcaster topic.",
+	}, []string{"topic"})
+	broadcasterSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "shim_broadcaster_subscribers",
+		Help: "Number of streams registered with the rotation broadcaster.",
+	})
+	credentialsAgeSeconds = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shim_credentials_age_seconds",
+		Help: "Seconds since the served leaf certificate file was modified (for in-memory credentials, since the last successful rebuild); 0 before the first one.",
+	}, credentialsAge)
+	activeStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shim_active_streams",
+		Help: "Number of open streams subscribed to rotation updates, by Workload API method.",
+	}, []string{"method"})
+)
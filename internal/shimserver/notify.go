@@ -0,0 +1,115 @@
+package shimserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds each Notifier call.
+const notifyTimeout = 30 * time.Second
+
+// maxHookOutput caps the command output included in an ExecNotifier error.
+const maxHookOutput = 512
+
+// Rotation describes a rotation pushed to the connected streams.
+type Rotation struct {
+	// SPIFFEID is the SPIFFE ID of the first served X.509 SVID.
+	SPIFFEID  string    `json:"spiffe_id"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// Notifier is told about every rotation whose rebuild succeeded, for
+// workloads that reload on a signal or webhook instead of consuming stream
+// updates. Notifiers run in their own goroutines after the broadcast, so a
+// slow or failing one never delays stream subscribers.
+type Notifier interface {
+	Notify(ctx context.Context, r Rotation) error
+}
+
+// ExecNotifier runs a command on every rotation, with the rotation passed in
+// the SPIFFE_ID and ROTATED_AT (RFC 3339) environment variables.
+type ExecNotifier struct {
+	Args []string
+}
+
+func (n ExecNotifier) Notify(ctx context.Context, r Rotation) error {
+	if len(n.Args) == 0 {
+		return errors.New("no command configured")
+	}
+	cmd := exec.CommandContext(ctx, n.Args[0], n.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SPIFFE_ID="+r.SPIFFEID,
+		"ROTATED_AT="+r.RotatedAt.UTC().Format(time.RFC3339),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = bytes.TrimSpace(out)
+		if len(out) > maxHookOutput {
+			out = out[len(out)-maxHookOutput:]
+		}
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
+
+func (n ExecNotifier) String() string { return "exec " + strings.Join(n.Args, " ") }
+
+// WebhookNotifier POSTs the rotation as a JSON object to URL on every
+// rotation. Any status other than 2xx is an error.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, r Rotation) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (n WebhookNotifier) String() string { return "webhook " + n.URL }
+
+// notify calls every configured notifier in the background.
+func (s *ShimServer) notify() {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	r := Rotation{RotatedAt: time.Now()}
+	if resp := s.x509SVID.Load(); resp != nil && len(resp.Svids) > 0 {
+		r.SPIFFEID = resp.Svids[0].SpiffeId
+	}
+	for _, n := range s.notifiers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Notify(ctx, r); err != nil {
+				slog.Warn("rotation notifier failed", "notifier", n, "error", err)
+				return
+			}
+			slog.Debug("rotation notifier succeeded", "notifier", n)
+		}()
+	}
+}
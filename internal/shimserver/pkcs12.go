@@ -0,0 +1,37 @@
+package shimserver
+
+import (
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// loadPKCS12 reads the named PKCS#12 file and returns the DER certificate
+// chain, leaf first, and the private key as PKCS#8 DER.
+func (s *ShimServer) loadPKCS12(name string) ([][]byte, []byte, error) {
+	data, err := s.creds.read(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	var passphrase string
+	if s.p12PassphraseFile != "" {
+		p, err := readPassphrase(s.p12PassphraseFile, s.readTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		passphrase = string(p)
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode %s: %w", name, err)
+	}
+	keyDER, err := marshalPKCS8(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	certDERs := [][]byte{leaf.Raw}
+	for _, cert := range chain {
+		certDERs = append(certDERs, cert.Raw)
+	}
+	return certDERs, keyDER, nil
+}
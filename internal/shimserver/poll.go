@@ -0,0 +1,110 @@
+package shimserver
+
+import (
+	"cmp"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pollSnapshot stats the credential files of every credentials directory and
+// the static credential files, keyed by path, with a nil entry for each file
+// that does not exist. Stat follows symlinks, so a repointed ..data link shows
+// up as changed files.
+func (s *ShimServer) pollSnapshot() map[string]os.FileInfo {
+	sets := s.credentialSets()
+	names := []string{s.caFile, s.bundlesFile, s.intermediatesFile, "hints.json", jwtSigningKeyFile,
+		// The next numbered set, so that adding one is noticed.
+		numberedFile(cmp.Or(s.p12File, s.certFile), len(sets)),
+	}
+	if s.sdsFile != "" {
+		names = append(names, s.sdsFile)
+	}
+	for _, set := range sets {
+		names = append(names, set.certSource())
+		if set.keySource() != set.certSource() {
+			names = append(names, set.keySource())
+		}
+	}
+	snap := make(map[string]os.FileInfo)
+	for _, path := range s.staticPaths {
+		fi, err := statTimeout(path, s.readTimeout)
+		if err != nil {
+			fi = nil
+		}
+		snap[path] = fi
+	}
+	for _, dir := range s.credsDirs {
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			fi, err := statTimeout(path, s.readTimeout)
+			if err != nil {
+				fi = nil
+			}
+			snap[path] = fi
+		}
+	}
+	return snap
+}
+
+// snapshotChanged reports whether any file was created, removed, replaced or
+// written between the two snapshots.
+func snapshotChanged(prev, next map[string]os.FileInfo) bool {
+	if len(prev) != len(next) {
+		return true
+	}
+	for path, a := range prev {
+		b, ok := next[path]
+		if !ok {
+			return true
+		}
+		if a == nil || b == nil {
+			if (a == nil) != (b == nil) {
+				return true
+			}
+			continue
+		}
+		if !os.SameFile(a, b) || !a.ModTime().Equal(b.ModTime()) || a.Size() != b.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// startPoller is the watch mode for filesystems without inotify support, such
+// as NFS and some CSI drivers: it stats the credential files every
+// pollInterval and rotates when their size, modification time or identity
+// changed. As with the fsnotify watcher, rotations are at least
+// minRotationInterval apart, and a change only rotates once the lock file
+// is gone.
+func (s *ShimServer) startPoller() {
+	slog.Info("credential watcher: polling credential files", "interval", s.pollInterval)
+	go func() {
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+		prev := s.pollSnapshot()
+		var lastRotation time.Time
+		pending := false
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			next := s.pollSnapshot()
+			if snapshotChanged(prev, next) {
+				pending = true
+			}
+			prev = next
+			if pending && s.lockedBy() != "" {
+				continue
+			}
+			if pending && time.Since(lastRotation) >= s.minRotationInterval {
+				pending = false
+				s.rotateIfChanged()
+				lastRotation = time.Now()
+			}
+		}
+	}()
+}
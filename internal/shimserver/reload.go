@@ -0,0 +1,38 @@
+package shimserver
+
+import (
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// Settings are the parts of the Config that can be changed on a running
+// server with Reload, without dropping open streams.
+type Settings struct {
+	// Debounce replaces Config.Debounce from the next credential file event.
+	Debounce time.Duration
+	// BundleAllow replaces Config.BundleAllow. A change rebuilds the bundle
+	// responses and pushes them to the open bundle streams.
+	BundleAllow []string
+}
+
+// settings holds the current Settings, swapped as a whole by Reload so that
+// readers never see a mix of old and new values.
+type settings struct {
+	debounce    time.Duration
+	bundleAllow map[string]bool // nil serves every trust domain
+}
+
+// Reload applies st to the running server.
+func (s *ShimServer) Reload(st Settings) {
+	next := &settings{debounce: st.Debounce, bundleAllow: allowSet(st.BundleAllow)}
+	prev := s.settings.Swap(next)
+	if prev.debounce != next.debounce {
+		slog.Info("debounce changed", "debounce", next.debounce)
+	}
+	if maps.Equal(prev.bundleAllow, next.bundleAllow) {
+		return
+	}
+	slog.Info("bundle allow list changed, rebuilding bundles", "bundle_allow", st.BundleAllow)
+	s.rotate()
+}
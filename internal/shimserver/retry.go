@@ -0,0 +1,78 @@
+package shimserver
+
+import (
+	"log/slog"
+	"time"
+)
+
+// rebuildBackoff is the delay before each retry of a failed rebuild. A rebuild
+// that fails mid-rotation is usually a torn read that succeeds once the
+// credential writer has finished.
+var rebuildBackoff = []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+
+// bundleParseBackoff is the delay before each re-read of a trust bundles
+// document that failed to parse, typically because it was read mid-write.
+var bundleParseBackoff = []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+
+// initialSendBackoff returns the delays before each of retries rebuilds of a
+// response a stream or call needs before any rebuild has succeeded, starting
+// at 25ms and doubling, so a client connecting during a rotation is not failed
+// by a torn read.
+func initialSendBackoff(retries int) []time.Duration {
+	backoff := make([]time.Duration, retries)
+	d := 25 * time.Millisecond
+	for i := range backoff {
+		backoff[i] = d
+		d *= 2
+	}
+	return backoff
+}
+
+// recoveryInterval is how often a failed rebuild is retried in the background.
+var recoveryInterval = 5 * time.Second
+
+// startRecovery retries the rebuild every recoveryInterval while the last one
+// failed. A fix to the credentials does not always raise a watched event (a
+// chmod, or a directory replaced while its watch was lost), so without this
+// streams would keep the last-good response until the next unrelated
+// rotation. On success a rotation signals the streams of every response the
+// recovery replaced, including those that connected while the rebuild was
+// failing.
+func (s *ShimServer) startRecovery() {
+	ticker := time.NewTicker(recoveryInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			if !s.degraded.Load() || s.rebuild() != nil {
+				continue
+			}
+			// Rotate rather than broadcast directly so the health and degraded
+			// state are updated in one place.
+			slog.Info("credentials recovered")
+			s.rotate()
+		}
+	}()
+}
+
+// withRetry calls fn, retrying after each delay in backoff while it fails, and
+// returns the last error. It stops waiting early if the server is closed.
+func (s *ShimServer) withRetry(backoff []time.Duration, fn func() error) error {
+	err := fn()
+	for _, d := range backoff {
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(d):
+		case <-s.done:
+			return err
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package shimserver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+)
+
+func TestRecoveryRotatesStreamsConnectedWhileFailing(t *testing.T) {
+	prevBackoff, prevInterval := rebuildBackoff, recoveryInterval
+	rebuildBackoff, recoveryInterval = nil, 20*time.Millisecond
+	t.Cleanup(func() { rebuildBackoff, recoveryInterval = prevBackoff, prevInterval })
+
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	early, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlyRecv := receive(early.Recv)
+	good := earlyRecv.next(t).Svids[0].X509Svid
+
+	broken := tf.clone()
+	broken["private_key.pem"] = []byte("not a key")
+	if err := shim.SetFiles(broken); err != nil {
+		t.Fatal(err)
+	}
+	if !shim.degraded.Load() {
+		t.Fatal("rebuild with a broken key did not fail")
+	}
+	// A stream connecting while the rebuild fails gets the last-good SVID.
+	late, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lateRecv := receive(late.Recv)
+	if !bytes.Equal(lateRecv.next(t).Svids[0].X509Svid, good) {
+		t.Fatal("stream connected while failing did not get the last-good SVID")
+	}
+
+	// Fix the files without a rotation, as a change that raises no watched
+	// event would; the background recovery has to notice.
+	tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, testSPIFFEID)
+	shim.baseSource().(*memSource).set(tf.clone())
+	for name, r := range map[string]*receiver[*workloadv1.X509SVIDResponse]{"early": earlyRecv, "late": lateRecv} {
+		if bytes.Equal(r.next(t).Svids[0].X509Svid, good) {
+			t.Fatalf("%s stream was not sent the recovered SVID", name)
+		}
+	}
+	if shim.degraded.Load() {
+		t.Fatal("still degraded after recovery")
+	}
+}
@@ -0,0 +1,52 @@
+package shimserver
+
+import (
+	"context"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// SPIFFEIDHeader is the gRPC metadata header with which a FetchX509SVID
+// caller selects the SVIDs it receives when several credential sets are
+// served. It may be repeated to select more than one SPIFFE ID; without it
+// every SVID is sent.
+const SPIFFEIDHeader = "spiffe-id"
+
+// requestedSPIFFEIDs returns the SPIFFE IDs selected by the caller of ctx,
+// or nil when it did not select any.
+func requestedSPIFFEIDs(ctx context.Context) []string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	return md.Get(SPIFFEIDHeader)
+}
+
+// selectSVIDs returns resp restricted to the SVIDs whose SPIFFE IDs are in
+// ids, in the order they are served. With no ids resp is returned as is. A
+// NotFound error is returned when any of ids is not served.
+func selectSVIDs(resp *workloadv1.X509SVIDResponse, ids []string) (*workloadv1.X509SVIDResponse, error) {
+	if len(ids) == 0 {
+		return resp, nil
+	}
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	selected := &workloadv1.X509SVIDResponse{Crl: resp.Crl, FederatedBundles: resp.FederatedBundles}
+	for _, svid := range resp.Svids {
+		if want[svid.SpiffeId] {
+			selected.Svids = append(selected.Svids, svid)
+			delete(want, svid.SpiffeId)
+		}
+	}
+	for _, id := range ids {
+		if want[id] {
+			return nil, status.Errorf(codes.NotFound, "no X.509 SVID for SPIFFE ID %q", id)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,70 @@
+package shimserver
+
+import (
+	"slices"
+	"testing"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestSelectSVIDsBySPIFFEIDHeader(t *testing.T) {
+	const one, two = "spiffe://example.org/one", "spiffe://example.org/two"
+	tf := newTestFiles(t)
+	for n, id := range []string{one, two} {
+		tf.files[numberedFile("certificates.pem", n+1)], tf.files[numberedFile("private_key.pem", n+1)] = tf.ca.issue(t, id)
+	}
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+
+	for _, tc := range []struct {
+		name     string
+		selected []string
+		want     []string
+		code     codes.Code
+	}{
+		{"all", nil, []string{testSPIFFEID, one, two}, codes.OK},
+		{"single match", []string{one}, []string{one}, codes.OK},
+		{"served order", []string{two, testSPIFFEID}, []string{testSPIFFEID, two}, codes.OK},
+		{"not found", []string{one, "spiffe://example.org/three"}, nil, codes.NotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := streamCtx(t)
+			for _, id := range tc.selected {
+				ctx = metadata.AppendToOutgoingContext(ctx, SPIFFEIDHeader, id)
+			}
+			stream, err := client.FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := stream.Recv()
+			if status.Code(err) != tc.code {
+				t.Fatalf("FetchX509SVID error = %v, want code %v", err, tc.code)
+			}
+			if err != nil {
+				return
+			}
+			if got := svidIDs(resp); !slices.Equal(got, tc.want) {
+				t.Fatalf("SVIDs for %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("kept on rotation", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(streamCtx(t), SPIFFEIDHeader, two)
+		stream, err := client.FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := receive(stream.Recv)
+		r.next(t)
+		tf.files["certificates-2.pem"], tf.files["private_key-2.pem"] = tf.ca.issue(t, two)
+		if err := shim.SetFiles(tf.clone()); err != nil {
+			t.Fatal(err)
+		}
+		if got := svidIDs(r.next(t)); !slices.Equal(got, []string{two}) {
+			t.Fatalf("SVIDs after rotation for %v, want [%s]", got, two)
+		}
+	})
+}
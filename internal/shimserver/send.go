@@ -0,0 +1,33 @@
+package shimserver
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// send sends m on stream, giving up once sendTimeout has elapsed so that a
+// client that stopped reading, and whose flow control window is full, cannot
+// hold its stream goroutine forever. The DeadlineExceeded error it returns
+// ends the stream; returning from the handler cancels the stream, which
+// unblocks the abandoned send. A zero timeout waits indefinitely.
+func (s *ShimServer) send(stream grpc.ServerStream, m proto.Message) error {
+	if s.sendTimeout <= 0 {
+		return stream.SendMsg(m)
+	}
+	ch := make(chan error, 1)
+	go func() {
+		ch <- stream.SendMsg(m)
+	}()
+	timer := time.NewTimer(s.sendTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-timer.C:
+		return status.Errorf(codes.DeadlineExceeded, "client did not read the response within %s", s.sendTimeout)
+	}
+}
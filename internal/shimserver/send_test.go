@@ -0,0 +1,54 @@
+package shimserver
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSendTimeoutDropsStreamThatIsNotRead(t *testing.T) {
+	tf := newTestFiles(t)
+	// Large responses fill the stream's flow control window after a few
+	// rotations.
+	cas := [][]byte{tf.ca.pem}
+	for range 200 {
+		cas = append(cas, newTestCA(t).pem)
+	}
+	tf.files["ca_certificates.pem"] = slices.Concat(cas...)
+	shim, client := startTestServer(t, Config{Files: tf.clone(), SendTimeout: 100 * time.Millisecond})
+
+	stream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	// Stop reading; rotate until the shim gives up on the stream.
+	deadline := time.Now().Add(10 * time.Second)
+	for shim.bcast.subscribers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream of a client that does not read was not dropped")
+		}
+		tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, testSPIFFEID)
+		if err := shim.SetFiles(tf.clone()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Once the client reads again, it gets the buffered responses and then
+	// the error that ended the stream.
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("stream ended with %v, want DeadlineExceeded", err)
+	}
+}
@@ -1,169 +1,713 @@
 package shimserver
 
 import (
-	"context"
+	"bytes"
+	"cmp"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
 	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
-// broadcaster fans out a rotation signal to all subscribed streams.
+// Broadcaster topics, one per streamed response type. Each Fetch method
+// subscribes to the topic of the response it sends.
+const (
+	topicX509SVID    = "x509svid"
+	topicX509Bundles = "x509bundles"
+	topicJWTBundles  = "jwtbundles"
+)
+
+// broadcaster fans out rotation signals to the streams subscribed to a topic,
+// so that a rotation only wakes the streams whose response changed.
 type broadcaster struct {
-	mu   sync.Mutex
+	mu     sync.Mutex
+	topics map[string]*topic
+	next   int
+}
+
+// topic holds the subscribers of one topic and the value last published to it.
+type topic struct {
 	subs map[int]chan struct{}
-	next int
+	last any
 }
 
-func newBroadcaster() *broadcaster {
-	return &broadcaster{subs: make(map[int]chan struct{})}
+func newBroadcaster(names ...string) *broadcaster {
+	b := &broadcaster{topics: make(map[string]*topic, len(names))}
+	for _, name := range names {
+		b.topics[name] = &topic{subs: make(map[int]chan struct{})}
+	}
+	return b
 }
 
-func (b *broadcaster) subscribe() (int, <-chan struct{}) {
+// subscribe registers a new subscriber to the named topic and returns its
+// signal channel along with a function that unregisters it. The returned
+// function is safe to call more than once, so it can be deferred even where
+// other cleanup paths may also call it, and a deferred call still runs if the
+// stream handler panics.
+func (b *broadcaster) subscribe(name string) (<-chan struct{}, func()) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	t := b.topics[name]
 	id := b.next
 	b.next++
 	ch := make(chan struct{}, 1)
-	b.subs[id] = ch
-	return id, ch
+	t.subs[id] = ch
+	broadcasterSubscribers.Inc()
+	slog.Debug("stream subscribed", "topic", name, "subscriber", id, "subscribers", len(t.subs))
+	var once sync.Once
+	return ch, func() { once.Do(func() { b.unsubscribe(name, id) }) }
 }
 
-func (b *broadcaster) unsubscribe(id int) {
+func (b *broadcaster) unsubscribe(name string, id int) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	delete(b.subs, id)
+	t := b.topics[name]
+	delete(t.subs, id)
+	broadcasterSubscribers.Dec()
+	slog.Debug("stream unsubscribed", "topic", name, "subscriber", id, "subscribers", len(t.subs))
 }
 
-func (b *broadcaster) broadcast() {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	for _, ch := range b.subs {
+// signal wakes every subscriber of the named topic t. b.mu must be held.
+//
+// A subscriber that has not consumed the previous signal already has one
+// pending, so the new signal is dropped. This loses no update: the pending
+// signal makes the stream load the latest cached response, which supersedes
+// the one the dropped signal was for. A larger buffer would only wake the
+// stream again for a response it has already sent. Drops are counted, and
+// logged with the subscriber, to identify streams that are slow to consume.
+func (b *broadcaster) signal(name string, t *topic) {
+	for id, ch := range t.subs {
 		select {
 		case ch <- struct{}{}:
-		default: // drop if subscriber hasn't consumed the previous signal yet
+		default:
+			broadcastDropsTotal.WithLabelValues(name).Inc()
+			slog.Debug("rotation signal dropped, stream has one pending", "topic", name, "subscriber", id)
 		}
 	}
 }
 
+// publish signals the subscribers of the named topic when v, the cached
+// response of the topic, is not the value of its previous publish. Comparing
+// with what was last published rather than with the value before the current
+// rebuild also covers responses replaced by a rebuild that did not publish,
+// such as a recovery attempt. It reports whether it signalled.
+func (b *broadcaster) publish(name string, v any) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.topics[name]
+	if v == t.last {
+		return false
+	}
+	t.last = v
+	b.signal(name, t)
+	return true
+}
+
+// Config holds the settings for a ShimServer.
+type Config struct {
+	// CredsDirs are the directories containing the SPIFFE credential files,
+	// searched in order. Each file is read from the first directory that
+	// contains it, except the trust bundles document, whose trust domains are
+	// merged across all directories.
+	CredsDirs []string
+	// Files, if non-nil, holds the credential files in memory, keyed by
+	// basename, and is used instead of CredsDirs. No watcher is started;
+	// SetFiles replaces the files and pushes the update to open streams.
+	Files map[string][]byte
+	// CredsLayout selects the file naming convention of the credential
+	// provider: "spiffe-helper" (the default) for certificates.pem,
+	// private_key.pem and ca_certificates.pem; "k8s-tls" for tls.crt, tls.key
+	// and ca.crt; or "sds-json", which reads the leaf chain, its key and the
+	// local CA certificates from the single Envoy SDS document SDSFile.
+	CredsLayout string
+	// SDSFile is the basename of the SDS document in the sds-json layout.
+	// Empty selects sds.json.
+	SDSFile string
+	// StaticCert, StaticKey and StaticBundle, when set, each hold the path,
+	// or the inline PEM data, of the leaf certificate chain, its private key
+	// and the local CA certificates, used instead of CertFile, KeyFile and
+	// CAFile in CredsDirs. They are set together, for local development
+	// against arbitrary test certificates; CredsDirs may then be empty. Files
+	// given by path are watched for changes.
+	StaticCert   string
+	StaticKey    string
+	StaticBundle string
+	// CertFile, KeyFile, CAFile and BundlesFile are the basenames within
+	// CredsDirs of the leaf certificate chain, its private key, the local CA
+	// certificates and the trust bundles document. Empty values select the
+	// defaults of CredsLayout and trust_bundles.json.
+	CertFile    string
+	KeyFile     string
+	CAFile      string
+	BundlesFile string
+	// RequireBundlesFile makes a missing BundlesFile an error. By default a
+	// missing file is treated as an empty federation set, and only the local
+	// trust domain (and any Federation endpoints) are served.
+	RequireBundlesFile bool
+	// StripChainRoot removes self-signed roots from the end of each leaf's
+	// certificate chain, for providers that write the full chain including
+	// the root, which an X509-SVID should not carry. A removed root that is
+	// not among the CA certificates is added to that SVID's bundle.
+	StripChainRoot bool
+	// IntermediatesFile is the basename of an optional PEM file of
+	// intermediate CA certificates appended to every SVID's chain, for
+	// providers that do not include them in the certificate file.
+	IntermediatesFile string
+	// LockFile, when set, names a sentinel file the credential writer holds
+	// while it rewrites the credentials: a name within each of CredsDirs, or
+	// an absolute path. The watcher does not rotate while it exists and
+	// rotates once it is removed.
+	LockFile string
+	// Debounce is the quiet period after a credential file event before an
+	// update is pushed; bursts of events within it are coalesced.
+	Debounce time.Duration
+	// MinRotationInterval is the minimum time between two rotations triggered
+	// by the watcher. Changes arriving sooner are held back and pushed as one
+	// rotation when the interval has passed. Zero disables the limit.
+	MinRotationInterval time.Duration
+	// JWTTTL is the lifetime of JWT-SVIDs minted by FetchJWTSVID.
+	JWTTTL time.Duration
+	// JWTKeyID is the kid header of minted JWT-SVIDs. When empty, the RFC 7638
+	// thumbprint of the signing key is used.
+	JWTKeyID string
+	// WatchFiles watches the individual credential files by path instead of
+	// the whole credentials directory.
+	WatchFiles bool
+	// WatchMode selects how rotations are detected: "fsnotify" (the default)
+	// or "poll", which stats the credential files every PollInterval. The
+	// fsnotify mode falls back to polling when the filesystem does not
+	// support inotify.
+	WatchMode string
+	// PollInterval is the interval between polls in the poll watch mode.
+	PollInterval time.Duration
+	// InitialSendRetries is the number of times a response requested before
+	// any rebuild succeeded is rebuilt after failing, 25ms apart and doubling,
+	// before the error is returned to the client. Zero disables the retries.
+	InitialSendRetries int
+	// ReadTimeout bounds each credential file read and stat, by the rebuild
+	// and the watcher, so that a hung filesystem cannot block a rebuild
+	// indefinitely. Zero disables the limit.
+	ReadTimeout time.Duration
+	// SendTimeout bounds each response sent on a Fetch stream. A client that
+	// does not read it in time has its stream ended with DeadlineExceeded.
+	// Zero disables the limit.
+	SendTimeout time.Duration
+	// KeyPassphraseFile is the path of a file holding the passphrase of
+	// encrypted private key files. It is re-read on every key load.
+	KeyPassphraseFile string
+	// P12File, when set, is the basename of a PKCS#12 file holding the leaf,
+	// its chain and its private key, read instead of CertFile and KeyFile.
+	P12File string
+	// P12PassphraseFile is the path of a file holding the passphrase of
+	// P12File. Without it the file is decoded with an empty passphrase.
+	P12PassphraseFile string
+	// BundleAllow, when non-empty, lists the federated trust domain names
+	// served by FetchX509Bundles and FetchJWTBundles; others are left out. The
+	// local trust domain is always served.
+	BundleAllow []string
+	// IncludeLocalJWTBundle ensures FetchJWTBundles always carries the local
+	// trust domain, adding the public key of jwt_signing_key.pem to it.
+	IncludeLocalJWTBundle bool
+	// StrictURISANs rejects leaf certificates with more than one URI SAN
+	// instead of serving the first one with a warning.
+	StrictURISANs bool
+	// StrictSPIFFEID rejects a leaf certificate whose first URI SAN is not a
+	// valid SPIFFE ID, as checked by spiffeid.FromURI: a lowercase trust
+	// domain and a path of valid segments, without query or fragment. By
+	// default only the spiffe scheme is required.
+	StrictSPIFFEID bool
+	// StrictX509SVID enforces the X509-SVID leaf constraints of the SPIFFE
+	// specification: the leaf must not be a CA, must have the
+	// digitalSignature key usage and must not have keyCertSign or cRLSign.
+	StrictX509SVID bool
+	// AllowedSPIFFEIDs, when non-empty, lists the SPIFFE IDs a leaf
+	// certificate may carry, each a path.Match pattern such as
+	// "spiffe://example.org/ns/*/sa/*". A leaf whose SPIFFE ID matches none of
+	// them is refused like any other invalid leaf.
+	AllowedSPIFFEIDs []string
+	// VerifyChain rejects a leaf certificate that does not chain, through
+	// the intermediates of its certificate file, to a certificate of CAFile.
+	// The validity period is not checked here; see RejectExpired.
+	VerifyChain bool
+	// Federation maps trust domain names to the URLs of their SPIFFE bundle
+	// endpoints (https_web profile). Each is polled every FederationRefresh
+	// (default 5m), and the fetched bundle replaces that domain's entry in
+	// trust_bundles.json.
+	Federation        map[string]string
+	FederationRefresh time.Duration
+	// MaxStreams caps the number of concurrently open Fetch streams across
+	// all methods. Zero means no limit.
+	MaxStreams int
+	// MaxStreamLifetime ends each Fetch stream cleanly once it has been open
+	// that long, so that clients reconnect and fetch afresh. Zero keeps
+	// streams open until the client ends them.
+	MaxStreamLifetime time.Duration
+	// ExpiryWarn is the remaining leaf validity below which a warning is logged
+	// on every rebuild. Zero disables the warning.
+	ExpiryWarn time.Duration
+	// AgeLogInterval is the interval at which the age of the served
+	// credentials is logged. Zero disables the log.
+	AgeLogInterval time.Duration
+	// RejectExpired refuses to serve a leaf certificate that is expired or not
+	// yet valid; the last good response keeps being served instead.
+	RejectExpired bool
+	// WriteDir, when set, is a directory the served default SVID is written
+	// to after every successful rebuild, as svid.pem (leaf and chain),
+	// svid_key.pem and svid_bundle.pem (local trust bundle), for consumers
+	// that only read files. Each file is replaced atomically.
+	WriteDir string
+	// Notifiers are called after every rotation whose rebuild succeeded.
+	Notifiers []Notifier
+	// Health, if set, reports SERVING while the most recent rebuild of the
+	// credentials succeeded and NOT_SERVING while it failed.
+	Health *health.Server
+}
+
 // ShimServer implements the SPIFFE Workload API by reading credentials from disk.
 type ShimServer struct {
 	workloadv1.UnimplementedSpiffeWorkloadAPIServer
-	credsDir string
-	bcast    *broadcaster
+	credsDirs             []string
+	creds                 credSource
+	certFile              string
+	keyFile               string
+	caFile                string
+	sdsFile               string
+	staticPaths           []string
+	lockPaths             []string
+	bundlesFile           string
+	intermediatesFile     string
+	stripChainRoot        bool
+	minRotationInterval   time.Duration
+	watchFiles            bool
+	pollInterval          time.Duration
+	readTimeout           time.Duration
+	sendTimeout           time.Duration
+	maxStreams            int
+	maxStreamLifetime     time.Duration
+	federation            map[string]string
+	federationRefresh     time.Duration
+	strictURISANs         bool
+	strictSPIFFEID        bool
+	strictX509SVID        bool
+	allowedSPIFFEIDs      []string
+	includeLocalJWTBundle bool
+	keyPassphraseFile     string
+	p12File               string
+	p12PassphraseFile     string
+	jwtTTL                time.Duration
+	jwtKeyID              string
+	expiryWarn            time.Duration
+	ageLogInterval        time.Duration
+	rejectExpired         bool
+	verifyChain           bool
+	requireBundlesFile    bool
+	writeDir              string
+	notifiers             []Notifier
+	initialSendBackoff    []time.Duration
+	health                *health.Server
+	bcast                 *broadcaster
+
+	settings atomic.Pointer[settings] // the Settings, replaced by Reload
+
+	streams  atomic.Int64 // open Fetch streams, bounded by maxStreams
+	degraded atomic.Bool  // the last rebuild failed; retried by startRecovery
+	draining atomic.Bool  // new Fetch calls are rejected, see Drain
+	healthMu sync.Mutex   // orders setHealth against Drain
+
+	watchMode   string // effective watch mode, after any fallback to polling
+	lastRebuild atomic.Pointer[rebuildStatus]
+
+	// appliedFingerprint is the fingerprint of the credential files at the
+	// last successful rotation by the watcher or the poller, whose goroutine
+	// alone accesses it after New.
+	appliedFingerprint string
+
+	rotateMu    sync.Mutex
+	rotating    bool // a rotation is running
+	rotateDirty bool // another rotation was requested while one was running
+
+	fedMu      sync.Mutex
+	fedBundles map[string]*spiffebundle.Bundle // last fetched bundle per federated trust domain
+
+	rebuildMu sync.Mutex
+	// sentBundles holds the trust domain entries, with their spiffe_sequence,
+	// of the cached bundle responses.
+	sentBundles map[string]trustDomainEntry
+
+	// Responses rebuilt by the watcher on rotation and shared by all streams.
+	x509SVID    atomic.Pointer[workloadv1.X509SVIDResponse]
+	x509Bundles atomic.Pointer[workloadv1.X509BundlesResponse]
+	jwtBundles  atomic.Pointer[workloadv1.JWTBundlesResponse]
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// New creates a ShimServer that reads credentials from credsDir and watches
+// New creates a ShimServer that reads credentials from cfg.CredsDirs and watches
 // for credential rotation, pushing updates to all connected streams.
-func New(credsDir string) (*ShimServer, error) {
+func New(cfg Config) (*ShimServer, error) {
+	static := cfg.StaticCert != "" || cfg.StaticKey != "" || cfg.StaticBundle != ""
+	if static && (cfg.StaticCert == "" || cfg.StaticKey == "" || cfg.StaticBundle == "") {
+		return nil, errors.New("static credentials need a certificate, a key and a bundle")
+	}
+	if len(cfg.CredsDirs) == 0 && cfg.Files == nil && !static {
+		return nil, errors.New("no credentials directory configured")
+	}
+	watchMode := cmp.Or(cfg.WatchMode, "fsnotify")
+	if watchMode != "fsnotify" && watchMode != "poll" {
+		return nil, fmt.Errorf("unsupported watch mode %q: must be fsnotify or poll", watchMode)
+	}
+	layoutName := cmp.Or(cfg.CredsLayout, "spiffe-helper")
+	layout, ok := credsLayouts[layoutName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported credentials layout %q: must be spiffe-helper, k8s-tls or sds-json", layoutName)
+	}
+	for _, pattern := range cfg.AllowedSPIFFEIDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid allowed SPIFFE ID pattern %q: %w", pattern, err)
+		}
+	}
 	s := &ShimServer{
-		credsDir: credsDir,
-		bcast:    newBroadcaster(),
+		credsDirs:             cfg.CredsDirs,
+		certFile:              cmp.Or(cfg.CertFile, layout.certFile),
+		keyFile:               cmp.Or(cfg.KeyFile, layout.keyFile),
+		caFile:                cmp.Or(cfg.CAFile, layout.caFile),
+		bundlesFile:           cmp.Or(cfg.BundlesFile, "trust_bundles.json"),
+		intermediatesFile:     cmp.Or(cfg.IntermediatesFile, "intermediate_ca.pem"),
+		stripChainRoot:        cfg.StripChainRoot,
+		lockPaths:             lockFilePaths(cfg.LockFile, cfg.CredsDirs),
+		minRotationInterval:   cfg.MinRotationInterval,
+		watchFiles:            cfg.WatchFiles,
+		pollInterval:          cmp.Or(cfg.PollInterval, 10*time.Second),
+		watchMode:             watchMode,
+		readTimeout:           cfg.ReadTimeout,
+		sendTimeout:           cfg.SendTimeout,
+		maxStreams:            cfg.MaxStreams,
+		maxStreamLifetime:     cfg.MaxStreamLifetime,
+		federation:            cfg.Federation,
+		federationRefresh:     cmp.Or(cfg.FederationRefresh, 5*time.Minute),
+		fedBundles:            make(map[string]*spiffebundle.Bundle),
+		strictURISANs:         cfg.StrictURISANs,
+		strictSPIFFEID:        cfg.StrictSPIFFEID,
+		strictX509SVID:        cfg.StrictX509SVID,
+		allowedSPIFFEIDs:      cfg.AllowedSPIFFEIDs,
+		includeLocalJWTBundle: cfg.IncludeLocalJWTBundle,
+		keyPassphraseFile:     cfg.KeyPassphraseFile,
+		p12File:               cfg.P12File,
+		p12PassphraseFile:     cfg.P12PassphraseFile,
+		jwtTTL:                cfg.JWTTTL,
+		jwtKeyID:              cfg.JWTKeyID,
+		expiryWarn:            cfg.ExpiryWarn,
+		ageLogInterval:        cfg.AgeLogInterval,
+		rejectExpired:         cfg.RejectExpired,
+		verifyChain:           cfg.VerifyChain,
+		requireBundlesFile:    cfg.RequireBundlesFile,
+		writeDir:              cfg.WriteDir,
+		notifiers:             cfg.Notifiers,
+		initialSendBackoff:    initialSendBackoff(max(cfg.InitialSendRetries, 0)),
+		health:                cfg.Health,
+		bcast:                 newBroadcaster(topicX509SVID, topicX509Bundles, topicJWTBundles),
+		done:                  make(chan struct{}),
+	}
+	s.settings.Store(&settings{debounce: cfg.Debounce, bundleAllow: allowSet(cfg.BundleAllow)})
+	if cfg.Files != nil {
+		s.creds = newMemSource(cfg.Files)
+	} else {
+		s.creds = &dirSource{dirs: cfg.CredsDirs, readTimeout: cfg.ReadTimeout}
+	}
+	if static {
+		if layoutName == "sds-json" || cfg.P12File != "" {
+			return nil, errors.New("static credentials cannot be combined with the sds-json layout or a PKCS#12 file")
+		}
+		st := &staticSource{credSource: s.creds, files: make(map[string]staticFile), readTimeout: cfg.ReadTimeout}
+		s.certFile = st.addStatic(cfg.StaticCert, "certificate")
+		s.keyFile = st.addStatic(cfg.StaticKey, "key")
+		s.caFile = st.addStatic(cfg.StaticBundle, "bundle")
+		s.staticPaths = st.paths()
+		s.creds = st
+	}
+	if layoutName == "sds-json" {
+		s.sdsFile = cmp.Or(cfg.SDSFile, "sds.json")
+		s.creds = &sdsSource{credSource: s.creds, file: s.sdsFile, certFile: s.certFile, keyFile: s.keyFile, caFile: s.caFile}
+	}
+	// Failures are reported by Validate; the accessors fall back to building
+	// from disk until a rebuild succeeds.
+	err := s.rebuild()
+	s.publish() // no stream is subscribed yet; records the initial responses
+	s.degraded.Store(err != nil)
+	s.setHealth(err == nil)
+	if err == nil {
+		s.writeOut()
+		if cfg.Files == nil {
+			s.appliedFingerprint = s.fingerprint()
+		}
+	}
+	s.startRecovery()
+	if s.ageLogInterval > 0 {
+		s.startAgeLog()
+	}
+	if len(s.federation) > 0 {
+		s.startFederation()
+	}
+	if cfg.Files != nil {
+		return s, nil
 	}
-	if err := s.startWatcher(); err != nil {
+	if watchMode == "poll" {
+		s.startPoller()
+		return s, nil
+	}
+	if err := s.startWatcher(); errors.Is(err, errors.ErrUnsupported) {
+		slog.Warn("credential watcher: filesystem does not support fsnotify, falling back to polling", "error", err)
+		s.watchMode = "poll"
+		s.startPoller()
+	} else if err != nil {
+		s.Close() // stops the goroutines started above
 		return nil, fmt.Errorf("start credential watcher: %w", err)
 	}
 	return s, nil
 }
 
-// startWatcher watches credsDir for file changes and broadcasts to active streams.
-// Changes are debounced by 100ms to coalesce rapid multi-file rotation events.
-func (s *ShimServer) startWatcher() error {
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
+// setHealth updates the health status of the server and of the Workload API
+// service, if a health server was configured.
+func (s *ShimServer) setHealth(ok bool) {
+	if s.health == nil {
+		return
 	}
-	if err := w.Add(s.credsDir); err != nil {
-		w.Close()
-		return err
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	st := healthpb.HealthCheckResponse_SERVING
+	if !ok || s.draining.Load() {
+		st = healthpb.HealthCheckResponse_NOT_SERVING
 	}
-	go func() {
-		defer w.Close()
-		var debounce *time.Timer
-		for {
-			select {
-			case event, ok := <-w.Events:
-				if !ok {
-					return
-				}
-				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
-					if debounce != nil {
-						debounce.Stop()
-					}
-					debounce = time.AfterFunc(100*time.Millisecond, func() {
-						log.Println("credentials rotated, pushing update to connected streams")
-						s.bcast.broadcast()
-					})
-				}
-			case err, ok := <-w.Errors:
-				if !ok {
-					return
-				}
-				log.Printf("credential watcher error: %v", err)
-			}
-		}
-	}()
+	s.health.SetServingStatus("", st)
+	s.health.SetServingStatus(workloadv1.SpiffeWorkloadAPI_ServiceDesc.ServiceName, st)
+}
+
+// SetFiles replaces the in-memory credential files of a server created with
+// Config.Files and pushes the rebuilt responses to open streams, as a
+// rotation on disk would. When another rotation is already running, it picks
+// up the new files and SetFiles returns without waiting for it.
+func (s *ShimServer) SetFiles(files map[string][]byte) error {
+	mem, ok := s.baseSource().(*memSource)
+	if !ok {
+		return errors.New("server does not use in-memory credentials")
+	}
+	mem.set(files)
+	s.rotate()
 	return nil
 }
 
+// Close stops the credential watcher and ends all open streams so that a
+// graceful gRPC shutdown can complete. It is safe to call more than once.
+func (s *ShimServer) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// Validate loads every required credential file once and returns the joined
+// errors of all that are missing or malformed, so a misconfigured deployment
+// can fail at startup rather than on the first client request.
+func (s *ShimServer) Validate() error {
+	var errs []error
+	if s.p12File != "" {
+		if _, _, err := s.loadPKCS12(s.p12File); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		certDERs, err := s.loadPEMDERs(s.certFile)
+		if err != nil {
+			errs = append(errs, err)
+		} else if len(certDERs) == 0 {
+			errs = append(errs, fmt.Errorf("no certificates found in %s", s.certFile))
+		}
+		if _, err := s.loadPrivateKeyPKCS8DER(s.keyFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := s.loadPEMDERs(s.caFile); err != nil {
+		errs = append(errs, err)
+	}
+	if tb, err := s.parseTrustBundles(); err != nil {
+		errs = append(errs, err)
+	} else if err := validateTrustBundles(tb); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", s.bundlesFile, err))
+	}
+	return errors.Join(errs...)
+}
+
 // loadPEMDERs decodes all PEM blocks in the named file and returns each block as raw DER bytes.
+// A file without any PEM block that parses as one or more concatenated DER
+// certificates, as some providers write to .der or .crt files, is returned as
+// those certificates.
 func (s *ShimServer) loadPEMDERs(name string) ([][]byte, error) {
-	data, err := os.ReadFile(filepath.Join(s.credsDir, name))
+	data, err := s.creds.read(name)
 	if err != nil {
 		return nil, fmt.Errorf("read %s: %w", name, err)
 	}
 	var ders [][]byte
-	for len(data) > 0 {
+	rest := data
+	for len(rest) > 0 {
 		var block *pem.Block
-		block, data = pem.Decode(data)
+		block, rest = pem.Decode(rest)
 		if block == nil {
 			break
 		}
 		ders = append(ders, block.Bytes)
 	}
+	if len(ders) == 0 && len(data) > 0 {
+		if certs, err := x509.ParseCertificates(data); err == nil {
+			for _, cert := range certs {
+				ders = append(ders, cert.Raw)
+			}
+		}
+	}
 	return ders, nil
 }
 
+// parsePrivateKeyDER parses an unencrypted DER private key in PKCS#8, SEC 1
+// (EC) or PKCS#1 (RSA) form.
+func parsePrivateKeyDER(der []byte) (any, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("not a PKCS#8, EC or RSA private key")
+}
+
 // loadPrivateKeyPKCS8DER reads a PEM private key and returns it as PKCS#8 DER,
-// converting EC or RSA keys if necessary.
+// converting EC or RSA keys if necessary. Every key is parsed and re-marshaled
+// so that unsupported algorithms are rejected here rather than passed to
+// clients. The first private key block in the file is used; other blocks,
+// such as certificates, are skipped. Encrypted keys are decrypted with the
+// passphrase from keyPassphraseFile. A file without any PEM block is parsed
+// as an unencrypted DER key.
 func (s *ShimServer) loadPrivateKeyPKCS8DER(name string) ([]byte, error) {
-	data, err := os.ReadFile(filepath.Join(s.credsDir, name))
+	data, err := s.creds.read(name)
 	if err != nil {
 		return nil, fmt.Errorf("read %s: %w", name, err)
 	}
-	block, _ := pem.Decode(data)
-	if block == nil {
-		return nil, fmt.Errorf("no PEM block in %s", name)
-	}
-	switch block.Type {
-	case "PRIVATE KEY":
-		return block.Bytes, nil
-	case "EC PRIVATE KEY":
-		key, err := x509.ParseECPrivateKey(block.Bytes)
+	if block, _ := pem.Decode(data); block == nil && len(data) > 0 {
+		key, err := parsePrivateKeyDER(data)
 		if err != nil {
-			return nil, fmt.Errorf("parse EC private key: %w", err)
+			if _, perr := x509.ParsePKIXPublicKey(data); perr == nil {
+				return nil, fmt.Errorf("%s holds a DER public key, not a private key: the key file must be the private key of the leaf certificate", name)
+			}
+			return nil, fmt.Errorf("no PEM block in %s, and not a DER private key: %w", name, err)
+		}
+		der, err := marshalPKCS8(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return der, nil
+	}
+	var skipped []string
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
 		}
-		return x509.MarshalPKCS8PrivateKey(key)
-	case "RSA PRIVATE KEY":
-		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if x509.IsEncryptedPEMBlock(block) {
+			pass, err := s.keyPassphrase()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if block, err = decryptLegacyPEMBlock(block, pass); err != nil {
+				return nil, fmt.Errorf("decrypt private key in %s: %w", name, err)
+			}
+		}
+		var key any
+		switch block.Type {
+		case "ENCRYPTED PRIVATE KEY":
+			pass, err := s.keyPassphrase()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			key, err = decryptPKCS8PrivateKey(block.Bytes, pass)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse PKCS#8 private key in %s: %w", name, err)
+			}
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse EC private key in %s: %w", name, err)
+			}
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse RSA private key in %s: %w", name, err)
+			}
+		default:
+			skipped = append(skipped, block.Type)
+			continue
+		}
+		der, err := marshalPKCS8(key)
 		if err != nil {
-			return nil, fmt.Errorf("parse RSA private key: %w", err)
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return der, nil
+	}
+	if slices.Contains(skipped, "PUBLIC KEY") || slices.Contains(skipped, "RSA PUBLIC KEY") {
+		return nil, fmt.Errorf("%s holds a public key, not a private key: the key file must be the private key of the leaf certificate", name)
+	}
+	if len(skipped) > 0 {
+		return nil, fmt.Errorf("no private key block in %s (found %s)", name, strings.Join(skipped, ", "))
+	}
+	return nil, fmt.Errorf("no PEM block in %s", name)
+}
+
+// marshalPKCS8 encodes a parsed private key as PKCS#8 DER. Only ECDSA P-256,
+// P-384 and P-521, RSA, and Ed25519 keys are accepted.
+func marshalPKCS8(key any) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %s", k.Curve.Params().Name)
 		}
-		return x509.MarshalPKCS8PrivateKey(key)
+	case *rsa.PrivateKey, ed25519.PrivateKey:
 	default:
-		return nil, fmt.Errorf("unsupported PEM block type %q in %s", block.Type, name)
+		return nil, fmt.Errorf("unsupported private key type %T", key)
 	}
+	return x509.MarshalPKCS8PrivateKey(key)
 }
 
 // trustBundlesFile mirrors the on-disk trust_bundles.json format.
@@ -178,24 +722,267 @@ type trustDomainEntry struct {
 
 type trustKey struct {
 	Use string   `json:"use"`
+	Kid string   `json:"kid,omitempty"`
 	Kty string   `json:"kty"`
 	Crv string   `json:"crv"`
 	X   string   `json:"x"`
 	Y   string   `json:"y"`
+	N   string   `json:"n,omitempty"` // RSA modulus
+	E   string   `json:"e,omitempty"` // RSA exponent
 	X5C []string `json:"x5c"`
 }
 
-// loadTrustBundles parses trust_bundles.json from the credentials directory.
+// loadTrustBundles returns the merged trust bundles with every malformed key
+// and every trust domain with an invalid name dropped, so one bad entry does
+// not take down the rest of the bundles.
 func (s *ShimServer) loadTrustBundles() (*trustBundlesFile, error) {
-	data, err := os.ReadFile(filepath.Join(s.credsDir, "trust_bundles.json"))
+	tb, err := s.parseTrustBundles()
+	if err != nil {
+		return nil, err
+	}
+	dropInvalidTrustKeys(tb)
+	return tb, nil
+}
+
+// parseTrustBundles parses trust_bundles.json from every credentials directory
+// that has one and merges their trust domains. A trust domain present in
+// several directories is taken from the first.
+func (s *ShimServer) parseTrustBundles() (*trustBundlesFile, error) {
+	// A writer that does not replace the file atomically can be caught
+	// mid-write, which shows up as malformed JSON; such reads are retried
+	// before the whole rebuild is. Read errors are not retried here.
+	var files []credFile
+	var docs []trustBundlesFile
+	var readErr error
+	err := s.withRetry(bundleParseBackoff, func() error {
+		files, readErr = s.creds.readAll(s.bundlesFile)
+		if readErr != nil {
+			return nil
+		}
+		docs = make([]trustBundlesFile, len(files))
+		for i, f := range files {
+			if err := json.Unmarshal(f.data, &docs[i]); err != nil {
+				return fmt.Errorf("parse %s: %w", f.path, err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(readErr, os.ErrNotExist) && !s.requireBundlesFile {
+		// A single trust domain deployment needs no trust bundles document.
+		slog.Debug("no trust bundles document, serving no federated trust domains", "file", s.bundlesFile)
+		files, readErr = nil, nil
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("read %s: %w", s.bundlesFile, readErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	merged := &trustBundlesFile{TrustDomains: make(map[string]trustDomainEntry)}
+	for i, f := range files {
+		for domain, entry := range docs[i].TrustDomains {
+			if _, ok := merged.TrustDomains[domain]; ok {
+				slog.Warn("trust domain defined in several credentials directories, using the first",
+					"trust_domain", domain, "path", f.path)
+				continue
+			}
+			merged.TrustDomains[domain] = entry
+		}
+	}
+	if err := s.mergeFederatedBundles(merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// validateTrustKey checks that key has the fields required by its use: x5c for
+// x509-svid keys, and the JWK parameters of its key type for jwt-svid keys.
+func validateTrustKey(key trustKey) error {
+	var missing []string
+	require := func(name, value string) {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+	switch key.Use {
+	case "x509-svid":
+		if len(key.X5C) == 0 {
+			missing = append(missing, "x5c")
+		}
+	case "jwt-svid":
+		switch key.Kty {
+		case "EC":
+			require("crv", key.Crv)
+			require("x", key.X)
+			require("y", key.Y)
+		case "RSA":
+			require("n", key.N)
+			require("e", key.E)
+		case "OKP":
+			require("crv", key.Crv)
+			require("x", key.X)
+		case "":
+			missing = append(missing, "kty")
+		default:
+			return fmt.Errorf("unsupported kty %q", key.Kty)
+		}
+	default:
+		return fmt.Errorf("unknown use %q", key.Use)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s key missing %s", key.Use, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validTrustDomainName returns an error unless domain is a bare, valid trust
+// domain name, as served in bundle map keys after "spiffe://".
+func validTrustDomainName(domain string) error {
+	td, err := spiffeid.TrustDomainFromString(domain)
+	if err != nil {
+		return fmt.Errorf("invalid trust domain name %q: %w", domain, err)
+	}
+	if td.Name() != domain {
+		return fmt.Errorf("invalid trust domain name %q: want the bare name %q", domain, td.Name())
+	}
+	return nil
+}
+
+// validateTrustBundles returns the joined errors of every invalid trust domain
+// name and malformed key in tb, naming the trust domain and index of each.
+func validateTrustBundles(tb *trustBundlesFile) error {
+	domains := make([]string, 0, len(tb.TrustDomains))
+	for domain := range tb.TrustDomains {
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+	var errs []error
+	for _, domain := range domains {
+		if err := validTrustDomainName(domain); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for i, key := range tb.TrustDomains[domain].Keys {
+			if err := validateTrustKey(key); err != nil {
+				errs = append(errs, fmt.Errorf("trust domain %s key %d: %w", domain, i, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dropInvalidTrustKeys removes the trust domains with invalid names and the
+// malformed keys from tb, logging each one.
+func dropInvalidTrustKeys(tb *trustBundlesFile) {
+	for domain, entry := range tb.TrustDomains {
+		if err := validTrustDomainName(domain); err != nil {
+			slog.Warn("skipping trust domain with an invalid name", "trust_domain", domain, "error", err)
+			delete(tb.TrustDomains, domain)
+			continue
+		}
+		var keys []trustKey
+		for i, key := range entry.Keys {
+			if err := validateTrustKey(key); err != nil {
+				slog.Warn("skipping malformed trust bundle key", "trust_domain", domain, "key", i, "error", err)
+				continue
+			}
+			keys = append(keys, key)
+		}
+		entry.Keys = keys
+		tb.TrustDomains[domain] = entry
+	}
+}
+
+// loadCABundle loads the local CA certificates with duplicates removed and
+// self-signed roots moved after the intermediates. Appending rotations often
+// leave the same CA in the file more than once; clients only need it once.
+// Otherwise the order of the file is kept.
+func (s *ShimServer) loadCABundle() ([][]byte, error) {
+	ders, err := s.loadPEMDERs(s.caFile)
 	if err != nil {
-		return nil, fmt.Errorf("read trust_bundles.json: %w", err)
+		return nil, err
 	}
-	var tb trustBundlesFile
-	if err := json.Unmarshal(data, &tb); err != nil {
-		return nil, fmt.Errorf("parse trust_bundles.json: %w", err)
+	seen := make(map[[sha256.Size]byte]bool, len(ders))
+	var intermediates, roots [][]byte
+	for _, der := range ders {
+		fp := sha256.Sum256(der)
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", s.caFile, err)
+		}
+		if isSelfSigned(cert) {
+			roots = append(roots, der)
+		} else {
+			intermediates = append(intermediates, der)
+		}
+	}
+	return append(intermediates, roots...), nil
+}
+
+// withIntermediates returns chain, a leaf-first certificate chain, with the
+// certificates of the optional intermediatesFile inserted after the leaf and
+// the intermediates already in chain but before any root at its end.
+// Certificates already in chain and self-signed roots in intermediatesFile
+// are left out.
+func (s *ShimServer) withIntermediates(chain [][]byte) ([][]byte, error) {
+	ders, err := s.loadPEMDERs(s.intermediatesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return chain, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[[sha256.Size]byte]bool, len(chain))
+	for _, der := range chain {
+		seen[sha256.Sum256(der)] = true
+	}
+	var extra [][]byte
+	for _, der := range ders {
+		fp := sha256.Sum256(der)
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", s.intermediatesFile, err)
+		}
+		if !isSelfSigned(cert) {
+			extra = append(extra, der)
+		}
+	}
+	if len(extra) == 0 {
+		return chain, nil
+	}
+	// Roots at the end of chain stay last.
+	certs, roots := splitChainRoots(chain)
+	out := make([][]byte, 0, len(chain)+len(extra))
+	out = append(out, certs...)
+	out = append(out, extra...)
+	return append(out, roots...), nil
+}
+
+// splitChainRoots splits the self-signed roots off the end of chain, a
+// leaf-first certificate chain. The leaf is always kept, even if self-signed.
+func splitChainRoots(chain [][]byte) (certs, roots [][]byte) {
+	end := len(chain)
+	for end > 1 {
+		cert, err := x509.ParseCertificate(chain[end-1])
+		if err != nil || !isSelfSigned(cert) {
+			break
+		}
+		end--
 	}
-	return &tb, nil
+	return chain[:end], chain[end:]
+}
+
+// isSelfSigned reports whether cert is a root, issued and signed by itself.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
 }
 
 // concatDERs concatenates a slice of DER byte slices into a single byte slice.
@@ -207,104 +994,505 @@ func concatDERs(ders [][]byte) []byte {
 	return out
 }
 
-// buildX509SVIDResponse reads the current credentials from disk and builds the response.
-func (s *ShimServer) buildX509SVIDResponse() (*workloadv1.X509SVIDResponse, error) {
-	certDERs, err := s.loadPEMDERs("certificates.pem")
+// checkKeyMatchesLeaf returns an error if the PKCS#8 private key does not
+// correspond to the leaf certificate's public key, e.g. after a torn read
+// paired an old certificate with a new key.
+func checkKeyMatchesLeaf(leaf *x509.Certificate, keyDER []byte) error {
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
 	if err != nil {
-		return nil, fmt.Errorf("load certificates: %w", err)
+		return fmt.Errorf("parse private key: %w", err)
 	}
-	if len(certDERs) == 0 {
-		return nil, fmt.Errorf("no certificates found in certificates.pem")
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", key)
 	}
-	keyDER, err := s.loadPrivateKeyPKCS8DER("private_key.pem")
-	if err != nil {
-		return nil, fmt.Errorf("load private key: %w", err)
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(leaf.PublicKey) {
+		return fmt.Errorf("private key does not match leaf certificate")
 	}
-	caDERs, err := s.loadPEMDERs("ca_certificates.pem")
+	return nil
+}
+
+// credentialSet names the certificate and key files of one X.509 SVID, or
+// the PKCS#12 file holding both.
+type credentialSet struct {
+	name     string
+	certFile string
+	keyFile  string
+	p12File  string
+}
+
+// loadCredentialSet returns the DER certificate chain of set, leaf first, and its private
+// key as PKCS#8 DER.
+func (s *ShimServer) loadCredentialSet(set credentialSet) ([][]byte, []byte, error) {
+	if set.p12File != "" {
+		return s.loadPKCS12(set.p12File)
+	}
+	certDERs, err := s.loadPEMDERs(set.certFile)
 	if err != nil {
-		return nil, fmt.Errorf("load CA certificates: %w", err)
+		return nil, nil, fmt.Errorf("load certificates: %w", err)
 	}
-	leaf, err := x509.ParseCertificate(certDERs[0])
+	if len(certDERs) == 0 {
+		return nil, nil, fmt.Errorf("no certificates found in %s", set.certFile)
+	}
+	keyDER, err := s.loadPrivateKeyPKCS8DER(set.keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("parse leaf certificate: %w", err)
+		return nil, nil, fmt.Errorf("load private key: %w", err)
+	}
+	return certDERs, keyDER, nil
+}
+
+// certSource returns the name of the file holding the certificates of set.
+func (set credentialSet) certSource() string {
+	return cmp.Or(set.p12File, set.certFile)
+}
+
+// keySource returns the name of the file holding the private key of set.
+func (set credentialSet) keySource() string {
+	return cmp.Or(set.p12File, set.keyFile)
+}
+
+// credentialSets returns the primary certFile/keyFile set followed by any
+// numbered sets (certificates-1.pem/private_key-1.pem, ...) present in
+// credsDirs. Numbering stops at the first missing certificate file. A set is
+// named after its certificate file without the extension. With p12File set,
+// the sets are the PKCS#12 file and its numbered variants instead.
+func (s *ShimServer) credentialSets() []credentialSet {
+	if s.p12File != "" {
+		sets := []credentialSet{{name: fileStem(s.p12File), p12File: s.p12File}}
+		for n := 1; ; n++ {
+			p12File := numberedFile(s.p12File, n)
+			if !s.creds.exists(p12File) {
+				return sets
+			}
+			sets = append(sets, credentialSet{name: fileStem(p12File), p12File: p12File})
+		}
 	}
+	sets := []credentialSet{{name: fileStem(s.certFile), certFile: s.certFile, keyFile: s.keyFile}}
+	for n := 1; ; n++ {
+		certFile := numberedFile(s.certFile, n)
+		if !s.creds.exists(certFile) {
+			return sets
+		}
+		sets = append(sets, credentialSet{
+			name:     fileStem(certFile),
+			certFile: certFile,
+			keyFile:  numberedFile(s.keyFile, n),
+		})
+	}
+}
+
+// checkX509SVIDLeaf checks the key usage and basic constraints the X509-SVID
+// specification requires of a leaf certificate.
+func checkX509SVIDLeaf(leaf *x509.Certificate) error {
+	if leaf.IsCA {
+		return errors.New("leaf certificate is a CA certificate")
+	}
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return errors.New("leaf certificate lacks the digitalSignature key usage")
+	}
+	if leaf.KeyUsage&(x509.KeyUsageCertSign|x509.KeyUsageCRLSign) != 0 {
+		return errors.New("leaf certificate has the keyCertSign or cRLSign key usage")
+	}
+	return nil
+}
+
+// fileStem returns name without its extension.
+func fileStem(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// numberedFile returns the name of the nth numbered variant of name, inserting
+// "-n" before the extension: certificates.pem becomes certificates-1.pem.
+func numberedFile(name string, n int) string {
+	return fmt.Sprintf("%s-%d%s", fileStem(name), n, filepath.Ext(name))
+}
+
+// isNumberedFile reports whether name is a numbered variant of base as
+// produced by numberedFile.
+func isNumberedFile(name, base string) bool {
+	rest, ok := strings.CutPrefix(name, fileStem(base)+"-")
+	if !ok {
+		return false
+	}
+	digits, ok := strings.CutSuffix(rest, filepath.Ext(base))
+	if !ok || digits == "" {
+		return false
+	}
+	return strings.Trim(digits, "0123456789") == ""
+}
+
+// leafSPIFFEID returns the SPIFFE ID of leaf, taken from its first URI SAN,
+// which must have the spiffe scheme, and with strictSPIFFEID be a valid SPIFFE
+// ID. An X509-SVID should carry exactly one URI SAN; extra ones are reported
+// with a warning, or rejected with strictURISANs. With strictX509SVID the leaf
+// must also satisfy checkX509SVIDLeaf. The SPIFFE ID must match the allow
+// list of spiffeIDAllowed.
+func (s *ShimServer) leafSPIFFEID(leaf *x509.Certificate) (*url.URL, error) {
 	if len(leaf.URIs) == 0 {
-		return nil, fmt.Errorf("leaf certificate has no URI SANs")
-	}
-	return &workloadv1.X509SVIDResponse{
-		Svids: []*workloadv1.X509SVID{
-			{
-				SpiffeId:    leaf.URIs[0].String(),
-				X509Svid:    concatDERs(certDERs),
-				X509SvidKey: keyDER,
-				Bundle:      concatDERs(caDERs),
-			},
-		},
-	}, nil
+		return nil, errors.New("leaf certificate has no URI SANs")
+	}
+	id := leaf.URIs[0]
+	if id.Scheme != "spiffe" {
+		slog.Warn("rejecting leaf certificate whose URI SAN is not a SPIFFE ID", "uri", id.String())
+		return nil, fmt.Errorf("first URI SAN %q of leaf certificate does not have the spiffe scheme", id)
+	}
+	if s.strictSPIFFEID {
+		if _, err := spiffeid.FromURI(id); err != nil {
+			slog.Warn("rejecting leaf certificate whose URI SAN is not a valid SPIFFE ID", "uri", id.String(), "error", err)
+			return nil, fmt.Errorf("first URI SAN %q of leaf certificate is not a valid SPIFFE ID: %w", id, err)
+		}
+	}
+	if s.strictX509SVID {
+		if err := checkX509SVIDLeaf(leaf); err != nil {
+			slog.Warn("rejecting non-conformant X509-SVID leaf certificate", "spiffe_id", id.String(), "error", err)
+			return nil, err
+		}
+	}
+	if !s.spiffeIDAllowed(id.String()) {
+		slog.Error("refusing to serve leaf certificate whose SPIFFE ID is not allowed", "spiffe_id", id.String())
+		return nil, fmt.Errorf("SPIFFE ID %s of leaf certificate matches no allowed SPIFFE ID", id)
+	}
+	if len(leaf.URIs) > 1 {
+		if s.strictURISANs {
+			return nil, fmt.Errorf("leaf certificate has %d URI SANs, want exactly one", len(leaf.URIs))
+		}
+		slog.Warn("leaf certificate has several URI SANs, using the first",
+			"spiffe_id", id.String(), "uri_sans", len(leaf.URIs))
+	}
+	return id, nil
 }
 
-// buildX509BundlesResponse reads the current trust bundles from disk and builds the response.
-func (s *ShimServer) buildX509BundlesResponse() (*workloadv1.X509BundlesResponse, error) {
-	certDERs, err := s.loadPEMDERs("certificates.pem")
+// spiffeIDAllowed reports whether id matches one of allowedSPIFFEIDs, or
+// whether no allow list is configured.
+func (s *ShimServer) spiffeIDAllowed(id string) bool {
+	if len(s.allowedSPIFFEIDs) == 0 {
+		return true
+	}
+	for _, pattern := range s.allowedSPIFFEIDs {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLeafValidity records the leaf's remaining validity, warns when it is
+// within the expiry warning window, and, if rejectExpired is set, returns an
+// error when the leaf is outside its validity period.
+func (s *ShimServer) checkLeafValidity(leaf *x509.Certificate, spiffeID string) error {
+	now := time.Now()
+	remaining := leaf.NotAfter.Sub(now)
+	svidExpirySeconds.WithLabelValues(spiffeID).Set(remaining.Seconds())
+	if s.rejectExpired {
+		if now.After(leaf.NotAfter) {
+			return fmt.Errorf("leaf certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(leaf.NotBefore) {
+			return fmt.Errorf("leaf certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+		}
+	}
+	if s.expiryWarn > 0 && remaining < s.expiryWarn {
+		slog.Warn("SVID is close to expiry or expired; is credential rotation stalled?",
+			"spiffe_id", spiffeID, "not_after", leaf.NotAfter, "remaining", remaining.Round(time.Second))
+	}
+	return nil
+}
+
+// verifyLeafChain returns an error unless leaf chains to one of cas, using the
+// remaining certificates of its chain as intermediates. Every CA certificate is
+// accepted as a trust anchor, so a file holding only an intermediate also
+// verifies. The check runs at a time within the leaf's validity period, leaving
+// expiry to checkLeafValidity.
+func verifyLeafChain(leaf *x509.Certificate, chainDERs [][]byte, cas *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, der := range chainDERs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parse intermediate certificate: %w", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	at := time.Now()
+	if at.Before(leaf.NotBefore) {
+		at = leaf.NotBefore
+	} else if at.After(leaf.NotAfter) {
+		at = leaf.NotAfter
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         cas,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
 	if err != nil {
-		return nil, fmt.Errorf("load certificates: %w", err)
+		return fmt.Errorf("leaf certificate does not chain to the local CA certificates: %w", err)
 	}
-	if len(certDERs) == 0 {
-		return nil, fmt.Errorf("no certificates found in certificates.pem")
+	return nil
+}
+
+// buildX509SVID reads one credential set from disk and builds its SVID entry.
+// A non-nil cas enables the chain verification of verifyLeafChain.
+func (s *ShimServer) buildX509SVID(set credentialSet, bundle []byte, cas *x509.CertPool) (*workloadv1.X509SVID, error) {
+	certDERs, keyDER, err := s.loadCredentialSet(set)
+	if err != nil {
+		return nil, err
+	}
+	if certDERs, err = s.withIntermediates(certDERs); err != nil {
+		return nil, err
 	}
 	leaf, err := x509.ParseCertificate(certDERs[0])
 	if err != nil {
-		return nil, fmt.Errorf("parse leaf certificate: %w", err)
+		return nil, fmt.Errorf("parse leaf certificate in %s: %w", set.certSource(), err)
 	}
-	if len(leaf.URIs) == 0 {
-		return nil, fmt.Errorf("leaf certificate has no URI SANs")
+	id, err := s.leafSPIFFEID(leaf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", set.certSource(), err)
 	}
-	localTD := "spiffe://" + leaf.URIs[0].Host
+	if err := checkKeyMatchesLeaf(leaf, keyDER); err != nil {
+		return nil, fmt.Errorf("%s: %w", set.keySource(), err)
+	}
+	if cas != nil {
+		if err := verifyLeafChain(leaf, certDERs[1:], cas); err != nil {
+			return nil, fmt.Errorf("%s: %w", set.certSource(), err)
+		}
+	}
+	spiffeID := id.String()
+	if err := s.checkLeafValidity(leaf, spiffeID); err != nil {
+		return nil, fmt.Errorf("%s: %w", set.certSource(), err)
+	}
+	if s.stripChainRoot {
+		var roots [][]byte
+		certDERs, roots = splitChainRoots(certDERs)
+		for _, root := range roots {
+			if !bytes.Contains(bundle, root) {
+				slog.Warn("root certificate in the certificate chain is not among the CA certificates, adding it to the SVID bundle",
+					"file", set.certSource(), "spiffe_id", spiffeID)
+				bundle = append(slices.Clip(bundle), root...)
+			}
+		}
+	}
+	return &workloadv1.X509SVID{
+		SpiffeId:    spiffeID,
+		X509Svid:    concatDERs(certDERs),
+		X509SvidKey: keyDER,
+		Bundle:      bundle,
+	}, nil
+}
 
-	caDERs, err := s.loadPEMDERs("ca_certificates.pem")
+// buildX509SVIDResponse reads the current credentials from disk and builds the
+// response, with one SVID per credential set sharing the ca_certificates.pem bundle.
+func (s *ShimServer) buildX509SVIDResponse() (*workloadv1.X509SVIDResponse, error) {
+	caDERs, err := s.loadCABundle()
 	if err != nil {
 		return nil, fmt.Errorf("load CA certificates: %w", err)
 	}
-	bundles := map[string][]byte{localTD: concatDERs(caDERs)}
+	hints, err := s.loadHints()
+	if err != nil {
+		return nil, fmt.Errorf("load hints: %w", err)
+	}
+	bundle := concatDERs(caDERs)
+	var cas *x509.CertPool
+	if s.verifyChain {
+		cas = x509.NewCertPool()
+		for _, der := range caDERs {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %w", s.caFile, err)
+			}
+			cas.AddCert(cert)
+		}
+	}
+	resp := &workloadv1.X509SVIDResponse{}
+	seenHints := make(map[string]string)
+	for _, set := range s.credentialSets() {
+		svid, err := s.buildX509SVID(set, bundle, cas)
+		if err != nil {
+			return nil, err
+		}
+		svid.Hint = hints[set.name]
+		if svid.Hint != "" {
+			// Hints must be unique within a response; the first set wins.
+			if first, ok := seenHints[svid.Hint]; ok {
+				slog.Warn("skipping SVID with duplicate hint", "credential_set", set.name, "spiffe_id", svid.SpiffeId, "hint", svid.Hint, "first_credential_set", first)
+				continue
+			}
+			seenHints[svid.Hint] = set.name
+		}
+		resp.Svids = append(resp.Svids, svid)
+	}
+	return resp, nil
+}
+
+// loadHints parses the optional hints.json, which maps credential set names
+// (e.g. "certificates", "certificates-1") to the hint of that set's SVID.
+// A missing file means no hints.
+func (s *ShimServer) loadHints() (map[string]string, error) {
+	data, err := s.creds.read("hints.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read hints.json: %w", err)
+	}
+	var hints map[string]string
+	if err := json.Unmarshal(data, &hints); err != nil {
+		return nil, fmt.Errorf("parse hints.json: %w", err)
+	}
+	return hints, nil
+}
 
-	tb, err := s.loadTrustBundles()
+// allowSet returns the set of names, or nil when names is empty.
+func allowSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// bundleAllowed reports whether the federated trust domain is served to
+// clients under the current bundle allow list.
+func (s *ShimServer) bundleAllowed(domain string) bool {
+	allow := s.settings.Load().bundleAllow
+	return allow == nil || allow[domain]
+}
+
+// localTrustDomain returns the trust domain name of the primary leaf
+// certificate, the host of its SPIFFE ID. A host that is not a bare, valid
+// trust domain name, such as one with a port, is an error rather than a
+// malformed bundle map key.
+func (s *ShimServer) localTrustDomain() (string, error) {
+	primary := s.credentialSets()[0]
+	certDERs, _, err := s.loadCredentialSet(primary)
 	if err != nil {
-		return nil, fmt.Errorf("load trust bundles: %w", err)
+		return "", err
+	}
+	leaf, err := x509.ParseCertificate(certDERs[0])
+	if err != nil {
+		return "", fmt.Errorf("parse leaf certificate: %w", err)
+	}
+	id, err := s.leafSPIFFEID(leaf)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", primary.certSource(), err)
+	}
+	if err := validTrustDomainName(id.Host); err != nil {
+		return "", fmt.Errorf("%s: SPIFFE ID %s: %w", primary.certSource(), id, err)
+	}
+	return id.Host, nil
+}
+
+// errLocalBundleUnavailable marks a bundles response built without the local
+// trust domain because the leaf or the CA certificates could not be loaded.
+// It is returned together with the federated-only response.
+var errLocalBundleUnavailable = errors.New("local trust domain bundle unavailable")
+
+// localBundleError wraps err, the failure to load the local trust domain's
+// bundle, so that it matches errLocalBundleUnavailable.
+func localBundleError(err error) error {
+	return fmt.Errorf("%w: %w", errLocalBundleUnavailable, err)
+}
+
+// buildX509BundlesResponse builds the response from the local CA bundle on disk
+// and the federated x509-svid keys in tb of the domains allowed by bundleAllow.
+//
+// When the local bundle cannot be loaded, e.g. during a gap between two local
+// SVIDs, the federated bundles are still returned, together with an error
+// matching errLocalBundleUnavailable, so that federation stays usable. With no
+// federated bundle either, only the error is returned.
+func (s *ShimServer) buildX509BundlesResponse(tb *trustBundlesFile) (*workloadv1.X509BundlesResponse, error) {
+	bundles := make(map[string][]byte)
+	var localTD string
+	var localErr error
+	if td, err := s.localTrustDomain(); err != nil {
+		localErr = err
+	} else if caDERs, err := s.loadCABundle(); err != nil {
+		localErr = fmt.Errorf("load CA certificates: %w", err)
+	} else {
+		localTD = "spiffe://" + td
+		bundles[localTD] = concatDERs(caDERs)
 	}
+
 	for domain, entry := range tb.TrustDomains {
 		tdKey := "spiffe://" + domain
-		if tdKey == localTD {
+		if tdKey == localTD || !s.bundleAllowed(domain) {
 			continue
 		}
-		var ders [][]byte
-		for _, key := range entry.Keys {
-			if key.Use != "x509-svid" {
-				continue
-			}
-			for _, b64cert := range key.X5C {
-				der, err := base64.StdEncoding.DecodeString(b64cert)
-				if err != nil {
-					return nil, fmt.Errorf("decode x5c entry for domain %s: %w", domain, err)
-				}
-				ders = append(ders, der)
-			}
+		// A malformed peer bundle drops only that domain, so one bad peer does
+		// not take down federation with every other trust domain.
+		certs, err := x509SVIDAuthorities(entry)
+		if err != nil {
+			bundleDomainErrorsTotal.WithLabelValues(domain).Inc()
+			slog.Error("skipping federated trust domain with malformed x509-svid keys",
+				"trust_domain", domain, "error", err)
+			continue
 		}
-		if len(ders) > 0 {
-			bundles[tdKey] = concatDERs(ders)
+		var bundle []byte
+		for _, cert := range certs {
+			bundle = append(bundle, cert.Raw...)
 		}
+		if len(bundle) > 0 {
+			bundles[tdKey] = bundle
+		}
+	}
+	if localErr != nil {
+		if len(bundles) == 0 {
+			return nil, localErr
+		}
+		slog.Warn("local trust domain bundle unavailable, serving federated X.509 bundles only", "error", localErr)
+		return &workloadv1.X509BundlesResponse{Bundles: bundles}, localBundleError(localErr)
 	}
 	return &workloadv1.X509BundlesResponse{Bundles: bundles}, nil
 }
 
-// buildJWTBundlesResponse reads the current trust bundles from disk and builds the response.
-func (s *ShimServer) buildJWTBundlesResponse() (*workloadv1.JWTBundlesResponse, error) {
-	tb, err := s.loadTrustBundles()
-	if err != nil {
-		return nil, fmt.Errorf("load trust bundles: %w", err)
+// x509SVIDAuthorities decodes the x5c certificates of the x509-svid keys in
+// entry, returning an error if any of them is not a valid certificate.
+func x509SVIDAuthorities(entry trustDomainEntry) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, key := range entry.Keys {
+		if key.Use != "x509-svid" {
+			continue
+		}
+		for i, b64cert := range key.X5C {
+			der, err := base64.StdEncoding.DecodeString(b64cert)
+			if err != nil {
+				return nil, fmt.Errorf("decode x5c entry %d: %w", i, err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("parse x5c entry %d: %w", i, err)
+			}
+			certs = append(certs, cert)
+		}
 	}
-	bundles := make(map[string][]byte)
+	return certs, nil
+}
+
+// buildJWTBundlesResponse builds the response from the jwt-svid keys in tb.
+// With includeLocalJWTBundle set, the local trust domain is always given a
+// bundle: the public key of jwt_signing_key.pem is added to it when the domain
+// has no entry in tb or the entry lacks that key. As for the X.509 bundles, a
+// local trust domain that cannot be determined leaves the federated bundles
+// served, with an error matching errLocalBundleUnavailable.
+func (s *ShimServer) buildJWTBundlesResponse(tb *trustBundlesFile) (*workloadv1.JWTBundlesResponse, error) {
+	var localTD string
+	var localErr error
+	if s.includeLocalJWTBundle || s.settings.Load().bundleAllow != nil {
+		td, err := s.localTrustDomain()
+		if err != nil {
+			localErr = err
+		} else {
+			localTD = td
+		}
+	}
+	keysByDomain := make(map[string][]json.RawMessage)
 	for domain, entry := range tb.TrustDomains {
-		var keys []json.RawMessage
+		if domain != localTD && !s.bundleAllowed(domain) {
+			continue
+		}
 		for _, key := range entry.Keys {
 			if key.Use != "jwt-svid" {
 				continue
@@ -313,8 +1501,22 @@ func (s *ShimServer) buildJWTBundlesResponse() (*workloadv1.JWTBundlesResponse,
 			if err != nil {
 				return nil, fmt.Errorf("marshal jwt key for domain %s: %w", domain, err)
 			}
-			keys = append(keys, b)
+			keysByDomain[domain] = append(keysByDomain[domain], b)
+		}
+	}
+	if s.includeLocalJWTBundle && localErr == nil {
+		keys, err := s.withLocalJWTKey(tb.TrustDomains[localTD], keysByDomain[localTD])
+		if err != nil {
+			return nil, err
 		}
+		if len(keys) == 0 {
+			slog.Warn("no jwt-svid keys for the local trust domain", "trust_domain", localTD)
+		}
+		keysByDomain[localTD] = keys
+	}
+
+	bundles := make(map[string][]byte)
+	for domain, keys := range keysByDomain {
 		if len(keys) == 0 {
 			continue
 		}
@@ -327,105 +1529,292 @@ func (s *ShimServer) buildJWTBundlesResponse() (*workloadv1.JWTBundlesResponse,
 		}
 		bundles["spiffe://"+domain] = jwksJSON
 	}
+	if localErr != nil {
+		if len(bundles) == 0 {
+			return nil, localErr
+		}
+		slog.Warn("local trust domain unavailable, serving federated JWT bundles only", "error", localErr)
+		return &workloadv1.JWTBundlesResponse{Bundles: bundles}, localBundleError(localErr)
+	}
 	return &workloadv1.JWTBundlesResponse{Bundles: bundles}, nil
 }
 
-// FetchX509SVID streams the X.509 SVID and pushes updates whenever credentials rotate.
+// withLocalJWTKey appends the public key of jwt_signing_key.pem to keys, the
+// JWKS of the local trust domain entry, unless entry already has a key with
+// the signer's kid or no signing key is present.
+func (s *ShimServer) withLocalJWTKey(entry trustDomainEntry, keys []json.RawMessage) ([]json.RawMessage, error) {
+	signer, err := s.loadJWTSigner()
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range entry.Keys {
+		if key.Use == "jwt-svid" && key.Kid == signer.kid {
+			return keys, nil
+		}
+	}
+	b, err := jose.JSONWebKey{Key: signer.key.Public(), KeyID: signer.kid, Use: "jwt-svid"}.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("marshal JWT signing key: %w", err)
+	}
+	return append(keys, b), nil
+}
+
+// acquireStream reserves one of the maxStreams stream slots, reporting false
+// when all are in use. A successful call must be paired with releaseStream.
+func (s *ShimServer) acquireStream() bool {
+	if n := s.streams.Add(1); s.maxStreams > 0 && n > int64(s.maxStreams) {
+		s.streams.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *ShimServer) releaseStream() {
+	s.streams.Add(-1)
+}
+
+// streamLifetime returns a channel that receives once a stream has been open
+// for maxStreamLifetime, or nil, which never receives, when no lifetime is set,
+// and a function that releases its timer.
+func (s *ShimServer) streamLifetime() (<-chan time.Time, func() bool) {
+	if s.maxStreamLifetime <= 0 {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(s.maxStreamLifetime)
+	return t.C, t.Stop
+}
+
+// streamLimitError is returned to Fetch calls rejected by the stream limit.
+func (s *ShimServer) streamLimitError() error {
+	slog.Warn("rejecting stream: concurrent stream limit reached", "max_streams", s.maxStreams)
+	return status.Errorf(codes.ResourceExhausted, "too many concurrent streams (limit %d)", s.maxStreams)
+}
+
+// credentialError converts a failure to load the served credentials into a
+// gRPC status: FailedPrecondition when a credential file is missing, so that
+// clients retry until it is provisioned, and Internal for anything else, such
+// as a corrupt file.
+func credentialError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return status.Errorf(codes.FailedPrecondition, "credentials not available: %v", err)
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
+
+// svidIDs returns the SPIFFE IDs of the SVIDs in resp, for logging.
+func svidIDs(resp *workloadv1.X509SVIDResponse) []string {
+	ids := make([]string, 0, len(resp.Svids))
+	for _, svid := range resp.Svids {
+		ids = append(ids, svid.SpiffeId)
+	}
+	return ids
+}
+
+// bundleDomains returns the sorted trust domains of a bundle map, for logging.
+func bundleDomains(bundles map[string][]byte) []string {
+	domains := make([]string, 0, len(bundles))
+	for domain := range bundles {
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+	return domains
+}
+
+// FetchX509SVID streams the X.509 SVID and pushes the rebuilt response whenever credentials rotate.
 func (s *ShimServer) FetchX509SVID(_ *workloadv1.X509SVIDRequest, stream workloadv1.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
-	resp, err := s.buildX509SVIDResponse()
+	// A client that has already gone away gets no response built for it.
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	if s.draining.Load() {
+		return drainingError()
+	}
+	if !s.acquireStream() {
+		return s.streamLimitError()
+	}
+	defer s.releaseStream()
+	// Subscribe before loading so a rotation that lands in between is not missed.
+	rotated, unsubscribe := s.bcast.subscribe(topicX509SVID)
+	defer unsubscribe()
+	activeStreams.WithLabelValues("FetchX509SVID").Inc()
+	defer activeStreams.WithLabelValues("FetchX509SVID").Dec()
+	expired, stopLifetime := s.streamLifetime()
+	defer stopLifetime()
+
+	requested := requestedSPIFFEIDs(stream.Context())
+	cached, err := s.x509SVIDResponse()
+	if err != nil {
+		return credentialError(err)
+	}
+	resp, err := selectSVIDs(cached, requested)
 	if err != nil {
-		return status.Errorf(codes.Internal, "%v", err)
+		return err
 	}
-	if err := stream.Send(resp); err != nil {
+	if err := s.send(stream, resp); err != nil {
+		streamSendErrorsTotal.WithLabelValues("FetchX509SVID").Inc()
+		slog.Warn("send initial response failed", "method", "FetchX509SVID", "error", err)
 		return err
 	}
-
-	id, rotated := s.bcast.subscribe()
-	defer s.bcast.unsubscribe(id)
+	slog.Debug("sent initial response", "method", "FetchX509SVID")
 
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.done:
+			return nil
+		case <-expired:
+			slog.Debug("stream reached its maximum lifetime, closing it", "method", "FetchX509SVID")
+			return nil
 		case <-rotated:
-			resp, err := s.buildX509SVIDResponse()
-			if err != nil {
-				log.Printf("FetchX509SVID: reload failed: %v", err)
-				continue
+			next := s.x509SVID.Load()
+			if next == nil || next == cached {
+				continue // rebuild failed; the client already has the last-good value
+			}
+			cached = next
+			// A selected identity that is no longer served ends the stream,
+			// rather than leaving the client with an SVID that stopped rotating.
+			if resp, err = selectSVIDs(cached, requested); err != nil {
+				return err
 			}
-			if err := stream.Send(resp); err != nil {
+			ids := svidIDs(resp)
+			if err := s.send(stream, resp); err != nil {
+				streamSendErrorsTotal.WithLabelValues("FetchX509SVID").Inc()
+				slog.Warn("send rotated response failed", "method", "FetchX509SVID", "spiffe_ids", ids, "error", err)
 				return err
 			}
+			slog.Debug("sent rotated response", "method", "FetchX509SVID", "spiffe_ids", ids)
 		}
 	}
 }
 
-// FetchX509Bundles streams the X.509 trust bundle map and pushes updates whenever credentials rotate.
+// FetchX509Bundles streams the X.509 trust bundle map and pushes the rebuilt map whenever credentials rotate.
 func (s *ShimServer) FetchX509Bundles(_ *workloadv1.X509BundlesRequest, stream workloadv1.SpiffeWorkloadAPI_FetchX509BundlesServer) error {
-	resp, err := s.buildX509BundlesResponse()
+	// A client that has already gone away gets no response built for it.
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	if s.draining.Load() {
+		return drainingError()
+	}
+	if !s.acquireStream() {
+		return s.streamLimitError()
+	}
+	defer s.releaseStream()
+	// Subscribe before loading so a rotation that lands in between is not missed.
+	rotated, unsubscribe := s.bcast.subscribe(topicX509Bundles)
+	defer unsubscribe()
+	activeStreams.WithLabelValues("FetchX509Bundles").Inc()
+	defer activeStreams.WithLabelValues("FetchX509Bundles").Dec()
+	expired, stopLifetime := s.streamLifetime()
+	defer stopLifetime()
+
+	resp, err := s.x509BundlesResponse()
 	if err != nil {
-		return status.Errorf(codes.Internal, "%v", err)
+		return credentialError(err)
 	}
-	if err := stream.Send(resp); err != nil {
+	if err := s.send(stream, resp); err != nil {
+		streamSendErrorsTotal.WithLabelValues("FetchX509Bundles").Inc()
+		slog.Warn("send initial response failed", "method", "FetchX509Bundles", "error", err)
 		return err
 	}
-
-	id, rotated := s.bcast.subscribe()
-	defer s.bcast.unsubscribe(id)
+	slog.Debug("sent initial response", "method", "FetchX509Bundles")
 
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.done:
+			return nil
+		case <-expired:
+			slog.Debug("stream reached its maximum lifetime, closing it", "method", "FetchX509Bundles")
+			return nil
 		case <-rotated:
-			resp, err := s.buildX509BundlesResponse()
-			if err != nil {
-				log.Printf("FetchX509Bundles: reload failed: %v", err)
+			next := s.x509Bundles.Load()
+			if next == nil || next == resp {
+				continue // rebuild failed; the client already has the last-good value
+			}
+			// A rebuilt map can equal the one already sent, e.g. after a
+			// failed SVID build forced a rebuild; skip the redundant send.
+			if proto.Equal(next, resp) {
+				resp = next
 				continue
 			}
-			if err := stream.Send(resp); err != nil {
+			resp = next
+			domains := bundleDomains(resp.Bundles)
+			if err := s.send(stream, resp); err != nil {
+				streamSendErrorsTotal.WithLabelValues("FetchX509Bundles").Inc()
+				slog.Warn("send rotated response failed", "method", "FetchX509Bundles", "trust_domains", domains, "error", err)
 				return err
 			}
+			slog.Debug("sent rotated response", "method", "FetchX509Bundles", "trust_domains", domains)
 		}
 	}
 }
 
-// FetchJWTBundles streams the JWT bundle map and pushes updates whenever credentials rotate.
+// FetchJWTBundles streams the JWT bundle map and pushes the rebuilt map whenever credentials rotate.
 func (s *ShimServer) FetchJWTBundles(_ *workloadv1.JWTBundlesRequest, stream workloadv1.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
-	resp, err := s.buildJWTBundlesResponse()
+	// A client that has already gone away gets no response built for it.
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	if s.draining.Load() {
+		return drainingError()
+	}
+	if !s.acquireStream() {
+		return s.streamLimitError()
+	}
+	defer s.releaseStream()
+	// Subscribe before loading so a rotation that lands in between is not missed.
+	rotated, unsubscribe := s.bcast.subscribe(topicJWTBundles)
+	defer unsubscribe()
+	activeStreams.WithLabelValues("FetchJWTBundles").Inc()
+	defer activeStreams.WithLabelValues("FetchJWTBundles").Dec()
+	expired, stopLifetime := s.streamLifetime()
+	defer stopLifetime()
+
+	resp, err := s.jwtBundlesResponse()
 	if err != nil {
-		return status.Errorf(codes.Internal, "%v", err)
+		return credentialError(err)
 	}
-	if err := stream.Send(resp); err != nil {
+	if err := s.send(stream, resp); err != nil {
+		streamSendErrorsTotal.WithLabelValues("FetchJWTBundles").Inc()
+		slog.Warn("send initial response failed", "method", "FetchJWTBundles", "error", err)
 		return err
 	}
-
-	id, rotated := s.bcast.subscribe()
-	defer s.bcast.unsubscribe(id)
+	slog.Debug("sent initial response", "method", "FetchJWTBundles")
 
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.done:
+			return nil
+		case <-expired:
+			slog.Debug("stream reached its maximum lifetime, closing it", "method", "FetchJWTBundles")
+			return nil
 		case <-rotated:
-			resp, err := s.buildJWTBundlesResponse()
-			if err != nil {
-				log.Printf("FetchJWTBundles: reload failed: %v", err)
+			next := s.jwtBundles.Load()
+			if next == nil || next == resp {
+				continue // rebuild failed; the client already has the last-good value
+			}
+			// A rebuilt map can equal the one already sent, e.g. after a
+			// failed SVID build forced a rebuild; skip the redundant send.
+			if proto.Equal(next, resp) {
+				resp = next
 				continue
 			}
-			if err := stream.Send(resp); err != nil {
+			resp = next
+			domains := bundleDomains(resp.Bundles)
+			if err := s.send(stream, resp); err != nil {
+				streamSendErrorsTotal.WithLabelValues("FetchJWTBundles").Inc()
+				slog.Warn("send rotated response failed", "method", "FetchJWTBundles", "trust_domains", domains, "error", err)
 				return err
 			}
+			slog.Debug("sent rotated response", "method", "FetchJWTBundles", "trust_domains", domains)
 		}
 	}
 }
-
-// FetchJWTSVID is not supported — no JWT signing keys are present in the credential files.
-func (s *ShimServer) FetchJWTSVID(_ context.Context, _ *workloadv1.JWTSVIDRequest) (*workloadv1.JWTSVIDResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "JWT SVIDs are not supported by this shim")
-}
-
-// ValidateJWTSVID is not supported — no JWT signing keys are present in the credential files.
-func (s *ShimServer) ValidateJWTSVID(_ context.Context, _ *workloadv1.ValidateJWTSVIDRequest) (*workloadv1.ValidateJWTSVIDResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "JWT SVID validation is not supported by this shim")
-}
@@ -0,0 +1,697 @@
+package shimserver
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func newRSAKey(t testing.TB) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// setKeys issues a new leaf for leafKey and makes jwtKey the JWT signing key.
+func (tf *testFiles) setKeys(t testing.TB, leafKey, jwtKey crypto.Signer) {
+	t.Helper()
+	tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issueFor(t, testSPIFFEID, leafKey)
+	tf.setJWTKey(t, jwtKey)
+}
+
+// jwtSVIDHeader mints a JWT-SVID, checks that it validates and returns its
+// header.
+func jwtSVIDHeader(t *testing.T, client workloadv1.SpiffeWorkloadAPIClient) jose.Header {
+	t.Helper()
+	resp, err := client.FetchJWTSVID(context.Background(), &workloadv1.JWTSVIDRequest{Audience: []string{"aud"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := resp.Svids[0].Svid
+	if _, err := client.ValidateJWTSVID(context.Background(), &workloadv1.ValidateJWTSVIDRequest{Audience: "aud", Svid: token}); err != nil {
+		t.Fatalf("validate JWT-SVID: %v", err)
+	}
+	tok, err := jwt.ParseSigned(token, jwtSVIDAlgorithms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok.Headers[0]
+}
+
+// localJWTKeyTypes returns the key types of the local JWT bundle.
+func localJWTKeyTypes(t *testing.T, resp *workloadv1.JWTBundlesResponse) []string {
+	t.Helper()
+	var jwks struct {
+		Keys []trustKey `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Bundles["spiffe://example.org"], &jwks); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, key := range jwks.Keys {
+		types = append(types, key.Kty)
+	}
+	return types
+}
+
+func TestKeyTypeRotation(t *testing.T) {
+	tf := newTestFiles(t)
+	tf.setKeys(t, newRSAKey(t), newRSAKey(t))
+	shim, client := startTestServer(t, Config{Files: tf.clone(), IncludeLocalJWTBundle: true, JWTTTL: time.Minute})
+	svids, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svidRecv := receive(svids.Recv)
+	jwtBundles, err := client.FetchJWTBundles(streamCtx(t), &workloadv1.JWTBundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtRecv := receive(jwtBundles.Recv)
+
+	key, err := x509.ParsePKCS8PrivateKey(svidRecv.next(t).Svids[0].X509SvidKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		t.Fatalf("X509 SVID key is %T, want *rsa.PrivateKey", key)
+	}
+	if got := localJWTKeyTypes(t, jwtRecv.next(t)); len(got) != 1 || got[0] != "RSA" {
+		t.Fatalf("local JWT bundle key types = %v, want [RSA]", got)
+	}
+	before := jwtSVIDHeader(t, client)
+	if before.Algorithm != string(jose.RS256) {
+		t.Fatalf("JWT-SVID alg = %s, want RS256", before.Algorithm)
+	}
+
+	leafKey, jwtKey := newECKey(t), newECKey(t)
+	tf.setKeys(t, leafKey, jwtKey)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	key, err = x509.ParsePKCS8PrivateKey(svidRecv.next(t).Svids[0].X509SvidKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec, ok := key.(*ecdsa.PrivateKey); !ok || !ec.Equal(leafKey) {
+		t.Fatalf("X509 SVID key is %T, want the rotated EC key", key)
+	}
+	if got := localJWTKeyTypes(t, jwtRecv.next(t)); len(got) != 1 || got[0] != "EC" {
+		t.Fatalf("local JWT bundle key types = %v, want [EC]", got)
+	}
+	after := jwtSVIDHeader(t, client)
+	if after.Algorithm != string(jose.ES256) {
+		t.Fatalf("JWT-SVID alg = %s, want ES256", after.Algorithm)
+	}
+	if after.KeyID == before.KeyID {
+		t.Fatalf("JWT-SVID kid %q did not change with the signing key", after.KeyID)
+	}
+}
+
+func TestDuplicateHintsKeepTheFirstSVID(t *testing.T) {
+	tf := newTestFiles(t)
+	for n, id := range []string{"spiffe://example.org/one", "spiffe://example.org/two"} {
+		cert, key := tf.ca.issue(t, id)
+		tf.files[numberedFile("certificates.pem", n+1)] = cert
+		tf.files[numberedFile("private_key.pem", n+1)] = key
+	}
+	tf.files["hints.json"] = []byte(`{"certificates": "a", "certificates-1": "a", "certificates-2": "b"}`)
+	_, client := startTestServer(t, Config{Files: tf.clone()})
+
+	resp := fetchX509SVID(t, client)
+	var got []string
+	for _, svid := range resp.Svids {
+		got = append(got, svid.SpiffeId+"="+svid.Hint)
+	}
+	want := []string{testSPIFFEID + "=a", "spiffe://example.org/two=b"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("SVIDs = %v, want %v", got, want)
+	}
+}
+
+func TestLoadPrivateKeyPKCS8DER(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, rsaKey := newECKey(t), newRSAKey(t)
+	pkcs8 := func(key any) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	sec1 := func(key *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	for _, tc := range []struct {
+		name string
+		file []byte
+		key  crypto.Signer
+	}{
+		{"ed25519", pemBlock("PRIVATE KEY", pkcs8(edKey)), edKey},
+		{"p256", pemBlock("PRIVATE KEY", pkcs8(p256)), p256},
+		{"p384", pemBlock("PRIVATE KEY", pkcs8(p384)), p384},
+		{"p521", pemBlock("PRIVATE KEY", pkcs8(p521)), p521},
+		{"rsa2048", pemBlock("PRIVATE KEY", pkcs8(rsaKey)), rsaKey},
+		{"sec1 p384", pemBlock("EC PRIVATE KEY", sec1(p384)), p384},
+		{"pkcs1 rsa2048", pemBlock("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), rsaKey},
+		{"der ed25519", pkcs8(edKey), edKey},
+		{"after certificate", append(pemBlock("CERTIFICATE", []byte("cert")), pemBlock("PRIVATE KEY", pkcs8(p256))...), p256},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shim, _ := startTestServer(t, Config{Files: map[string][]byte{"key.pem": tc.file}})
+			der, err := shim.loadPrivateKeyPKCS8DER("key.pem")
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				t.Fatalf("result is not PKCS#8: %v", err)
+			}
+			want := tc.key.Public().(interface{ Equal(crypto.PublicKey) bool })
+			if !want.Equal(key.(crypto.Signer).Public()) {
+				t.Fatal("result is not the key of the file")
+			}
+		})
+	}
+
+	t.Run("unsupported curve", func(t *testing.T) {
+		p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shim, _ := startTestServer(t, Config{Files: map[string][]byte{"key.pem": pemBlock("EC PRIVATE KEY", sec1(p224))}})
+		_, err = shim.loadPrivateKeyPKCS8DER("key.pem")
+		if err == nil || !strings.Contains(err.Error(), "unsupported EC curve P-224") {
+			t.Fatalf("error = %v, want an unsupported EC curve error", err)
+		}
+	})
+}
+
+func TestMaxStreams(t *testing.T) {
+	tf := newTestFiles(t)
+	_, client := startTestServer(t, Config{Files: tf.clone(), MaxStreams: 3})
+
+	// The limit is shared by the three Fetch methods.
+	fetchX509SVID(t, client)
+	x509Recv, jwtRecv := bundleStreams(t, client)
+	stream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("stream over the limit failed with %v, want ResourceExhausted", err)
+	}
+	x509Recv.none(t, 0)
+	jwtRecv.none(t, 0)
+}
+
+func TestCABundleIsDedupedWithRootsLast(t *testing.T) {
+	tf := newTestFiles(t)
+	other := newTestCA(t)
+	intermediate, _ := tf.ca.issue(t, "", func(c *x509.Certificate) {
+		c.IsCA, c.BasicConstraintsValid = true, true
+		c.KeyUsage = x509.KeyUsageCertSign
+	})
+	tf.files["ca_certificates.pem"] = slices.Concat(tf.ca.pem, intermediate, tf.ca.pem, other.pem, intermediate)
+	_, client := startTestServer(t, Config{Files: tf.clone()})
+
+	got := fetchX509SVID(t, client).Svids[0].Bundle
+	block, _ := pem.Decode(intermediate)
+	want := slices.Concat(block.Bytes, tf.ca.cert.Raw, other.cert.Raw)
+	if !bytes.Equal(got, want) {
+		t.Fatal("SVID bundle is not the intermediate followed by the two roots, each once")
+	}
+	stream, err := client.FetchX509Bundles(streamCtx(t), &workloadv1.X509BundlesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Bundles["spiffe://example.org"], want) {
+		t.Fatal("local X.509 bundle is not the intermediate followed by the two roots, each once")
+	}
+}
+
+// subscribers returns the number of subscribers of all broadcaster topics.
+func (b *broadcaster) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, t := range b.topics {
+		n += len(t.subs)
+	}
+	return n
+}
+
+func TestUnsubscribeIsIdempotent(t *testing.T) {
+	b := newBroadcaster(topicX509SVID)
+	before := testutil.ToFloat64(broadcasterSubscribers)
+	_, unsubscribe := b.subscribe(topicX509SVID)
+	unsubscribe()
+	unsubscribe()
+	if n := b.subscribers(); n != 0 {
+		t.Fatalf("%d subscribers left, want 0", n)
+	}
+	if got := testutil.ToFloat64(broadcasterSubscribers); got != before {
+		t.Fatalf("shim_broadcaster_subscribers = %v, want %v", got, before)
+	}
+}
+
+func TestClosedStreamsUnsubscribe(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := range 1000 {
+		var err error
+		switch i % 3 {
+		case 0:
+			var s workloadv1.SpiffeWorkloadAPI_FetchX509SVIDClient
+			if s, err = client.FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{}); err == nil {
+				_, err = s.Recv()
+			}
+		case 1:
+			var s workloadv1.SpiffeWorkloadAPI_FetchX509BundlesClient
+			if s, err = client.FetchX509Bundles(ctx, &workloadv1.X509BundlesRequest{}); err == nil {
+				_, err = s.Recv()
+			}
+		case 2:
+			var s workloadv1.SpiffeWorkloadAPI_FetchJWTBundlesClient
+			if s, err = client.FetchJWTBundles(ctx, &workloadv1.JWTBundlesRequest{}); err == nil {
+				_, err = s.Recv()
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := shim.bcast.subscribers(); n != 1000 {
+		t.Fatalf("%d subscribers with 1000 open streams", n)
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for shim.bcast.subscribers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers left after closing every stream", shim.bcast.subscribers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// gatedSource is a credSource whose first read or readAll blocks until
+// release is closed, signalling entered once it blocks.
+type gatedSource struct {
+	credSource
+	once             sync.Once
+	entered, release chan struct{}
+}
+
+func (g *gatedSource) wait() {
+	g.once.Do(func() {
+		close(g.entered)
+		<-g.release
+	})
+}
+
+func (g *gatedSource) read(name string) ([]byte, error) {
+	g.wait()
+	return g.credSource.read(name)
+}
+
+func (g *gatedSource) readAll(name string) ([]credFile, error) {
+	g.wait()
+	return g.credSource.readAll(name)
+}
+
+func TestConcurrentRotationsAreCoalesced(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, _ := startTestServer(t, Config{Files: tf.clone()})
+	gate := &gatedSource{credSource: shim.creds, entered: make(chan struct{}), release: make(chan struct{})}
+	shim.creds = gate
+	before := testutil.ToFloat64(rotationsTotal)
+
+	done := make(chan struct{})
+	go func() {
+		shim.rotate()
+		close(done)
+	}()
+	<-gate.entered
+	// Rotations made while one is rebuilding return at once.
+	for range 99 {
+		shim.rotate()
+	}
+	close(gate.release)
+	<-done
+
+	if n := testutil.ToFloat64(rotationsTotal) - before; n != 2 {
+		t.Fatalf("100 rotations, 99 of them during a rebuild, rebuilt %v times, want 2", n)
+	}
+}
+
+// tornSource is a credSource whose first torn reads of name return only the
+// first half of the file, as a read racing a non-atomic write would.
+type tornSource struct {
+	credSource
+	name string
+	torn atomic.Int32
+}
+
+func (ts *tornSource) readAll(name string) ([]credFile, error) {
+	files, err := ts.credSource.readAll(name)
+	if err != nil || name != ts.name || ts.torn.Add(-1) < 0 {
+		return files, err
+	}
+	torn := slices.Clone(files)
+	for i, f := range torn {
+		torn[i].data = f.data[:len(f.data)/2]
+	}
+	return torn, nil
+}
+
+func TestTornTrustBundlesReadIsRetried(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	mem := shim.creds.(*memSource)
+	torn := &tornSource{credSource: mem, name: "trust_bundles.json"}
+	shim.creds = torn
+	_, jwtRecv := bundleStreams(t, client)
+
+	tf.other = newECKey(t)
+	tf.setBundles(t, 1, 2)
+	mem.set(tf.clone())
+	torn.torn.Store(2)
+	errorsBefore := testutil.ToFloat64(rebuildErrorsTotal.WithLabelValues("jwt_bundles"))
+	shim.rotate()
+	if n := testutil.ToFloat64(rebuildErrorsTotal.WithLabelValues("jwt_bundles")) - errorsBefore; n != 0 {
+		t.Fatalf("rebuild failed %v times although the trust bundles were complete on the third read", n)
+	}
+	resp := jwtRecv.next(t)
+	if got, want := otherJWTKeyX(t, resp), jwtTrustKey(t, "k1", tf.other.Public()).X; got != want {
+		t.Fatal("JWT bundle of other.org is not the one of the complete read")
+	}
+}
+
+func TestTruncatedTrustBundlesKeepTheLastGoodBundles(t *testing.T) {
+	tf := newTestFiles(t)
+	shim, client := startTestServer(t, Config{Files: tf.clone()})
+	x509Recv, jwtRecv := bundleStreams(t, client)
+	before := shim.jwtBundles.Load()
+
+	truncated := tf.clone()
+	truncated["trust_bundles.json"] = truncated["trust_bundles.json"][:20]
+	if err := shim.SetFiles(truncated); err != nil {
+		t.Fatal(err)
+	}
+	x509Recv.none(t, 100*time.Millisecond)
+	jwtRecv.none(t, 0)
+	if !proto.Equal(shim.jwtBundles.Load(), before) {
+		t.Fatal("truncated trust bundles replaced the served JWT bundles")
+	}
+
+	tf.other = newECKey(t)
+	tf.setBundles(t, 1, 2)
+	if err := shim.SetFiles(tf.clone()); err != nil {
+		t.Fatal(err)
+	}
+	jwtRecv.next(t)
+}
+
+func TestLocalTrustDomainFromSPIFFEID(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		want string // empty when the host is not a valid trust domain name
+	}{
+		{"spiffe://example.org/workload", "example.org"},
+		{"spiffe://example.org", "example.org"},
+		{"spiffe://example.org/ns/prod/sa/web", "example.org"},
+		{"spiffe://example.org/", "example.org"},
+		{"spiffe://10.0.0.1/workload", "10.0.0.1"},
+		{"spiffe://example.org:8443/workload", ""},
+		{"spiffe://Example.org/workload", ""},
+		{"spiffe:///workload", ""},
+		{"spiffe://*.example.org/workload", ""},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			tf := newTestFiles(t)
+			tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, tc.id)
+			tf.files["trust_bundles.json"] = trustBundlesJSON(t, map[string]trustDomainEntry{
+				"other.org": {Keys: []trustKey{x509TrustKey(tf.ca.cert)}},
+			})
+			shim, client := startTestServer(t, Config{Files: tf.clone()})
+			// Without --strict-spiffe-id the SVID is served either way.
+			if got := fetchX509SVID(t, client).Svids[0].SpiffeId; got != tc.id {
+				t.Fatalf("SVID for %s, want %s", got, tc.id)
+			}
+
+			td, err := shim.localTrustDomain()
+			if tc.want == "" {
+				if err == nil || !strings.Contains(err.Error(), "invalid trust domain name") {
+					t.Fatalf("localTrustDomain() = %q, %v, want an invalid trust domain name error", td, err)
+				}
+			} else if err != nil || td != tc.want {
+				t.Fatalf("localTrustDomain() = %q, %v, want %q", td, err, tc.want)
+			}
+
+			stream, err := client.FetchX509Bundles(streamCtx(t), &workloadv1.X509BundlesRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"spiffe://other.org"}
+			if tc.want != "" {
+				want = append(want, "spiffe://"+tc.want)
+			}
+			got := slices.Sorted(maps.Keys(resp.Bundles))
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Fatalf("X.509 bundles for %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// chainOf returns the certificates of the PEM documents, concatenated as DER.
+func chainOf(t *testing.T, pems ...[]byte) []byte {
+	t.Helper()
+	var der []byte
+	for _, data := range pems {
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+			der = append(der, block.Bytes...)
+		}
+	}
+	return der
+}
+
+func TestIntermediatesFollowTheLeaf(t *testing.T) {
+	tf := newTestFiles(t)
+	inter := tf.ca.intermediate(t)
+	leaf, key := inter.issue(t, testSPIFFEID)
+	for _, tc := range []struct {
+		name          string
+		certs         []byte
+		intermediates []byte
+		want          []byte
+	}{
+		{"leaf only", leaf, inter.pem, chainOf(t, leaf, inter.pem)},
+		{"roots and duplicates skipped", leaf, slices.Concat(tf.ca.pem, inter.pem, leaf), chainOf(t, leaf, inter.pem)},
+		{"before the root of the chain", slices.Concat(leaf, tf.ca.pem), inter.pem, chainOf(t, leaf, inter.pem, tf.ca.pem)},
+		{"already in the chain", slices.Concat(leaf, inter.pem), inter.pem, chainOf(t, leaf, inter.pem)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := tf.clone()
+			files["certificates.pem"], files["private_key.pem"] = tc.certs, key
+			files["intermediate_ca.pem"] = tc.intermediates
+			_, client := startTestServer(t, Config{Files: files})
+			if got := fetchX509SVID(t, client).Svids[0].X509Svid; !bytes.Equal(got, tc.want) {
+				t.Fatal("SVID chain is not the leaf, then the intermediates, then any root")
+			}
+		})
+	}
+}
+
+func TestDERCredentialFiles(t *testing.T) {
+	tf := newTestFiles(t)
+	inter := tf.ca.intermediate(t)
+	ecKey, rsaKey := newECKey(t), newRSAKey(t)
+	ecLeaf, ecKeyPEM := inter.issueFor(t, testSPIFFEID, ecKey)
+	rsaLeaf, _ := inter.issueFor(t, testSPIFFEID, rsaKey)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		certs, ca []byte
+		key       []byte
+		leaf      []byte
+	}{
+		{"pem", slices.Concat(ecLeaf, inter.pem), tf.ca.pem, ecKeyPEM, ecLeaf},
+		{"der chain", chainOf(t, ecLeaf, inter.pem), chainOf(t, tf.ca.pem), ecKeyPEM, ecLeaf},
+		{"der pkcs8 key", slices.Concat(ecLeaf, inter.pem), tf.ca.pem, chainOf(t, ecKeyPEM), ecLeaf},
+		{"der sec1 key", slices.Concat(ecLeaf, inter.pem), tf.ca.pem, sec1, ecLeaf},
+		{"der pkcs1 key", chainOf(t, rsaLeaf, inter.pem), tf.ca.pem, x509.MarshalPKCS1PrivateKey(rsaKey), rsaLeaf},
+		{"all der", chainOf(t, rsaLeaf, inter.pem), chainOf(t, tf.ca.pem), x509.MarshalPKCS1PrivateKey(rsaKey), rsaLeaf},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := tf.clone()
+			files["certificates.pem"], files["private_key.pem"], files["ca_certificates.pem"] = tc.certs, tc.key, tc.ca
+			_, client := startTestServer(t, Config{Files: files})
+			svid := fetchX509SVID(t, client).Svids[0]
+			if !bytes.Equal(svid.X509Svid, chainOf(t, tc.leaf, inter.pem)) {
+				t.Error("SVID chain is not the leaf and the intermediate")
+			}
+			if !bytes.Equal(svid.Bundle, tf.ca.cert.Raw) {
+				t.Error("SVID bundle is not the CA")
+			}
+			key, err := x509.ParsePKCS8PrivateKey(svid.X509SvidKey)
+			if err != nil {
+				t.Fatalf("SVID key is not PKCS#8: %v", err)
+			}
+			leaf, err := x509.ParseCertificate(chainOf(t, tc.leaf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.(crypto.Signer).Public()) {
+				t.Error("SVID key is not the key of the leaf")
+			}
+		})
+	}
+}
+
+func TestMissingTrustBundlesFile(t *testing.T) {
+	tf := newTestFiles(t)
+	delete(tf.files, "trust_bundles.json")
+
+	t.Run("optional", func(t *testing.T) {
+		shim, client := startTestServer(t, Config{Files: tf.clone()})
+		if err := shim.Validate(); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+		x509Resp, jwtResp := fetchX509Bundles(t, client), fetchJWTBundles(t, client)
+		if got := slices.Collect(maps.Keys(x509Resp.Bundles)); !slices.Equal(got, []string{"spiffe://example.org"}) {
+			t.Errorf("X.509 bundles for %v, want only the local trust domain", got)
+		}
+		if !bytes.Equal(x509Resp.Bundles["spiffe://example.org"], tf.ca.cert.Raw) {
+			t.Error("local X.509 bundle is not the CA")
+		}
+		if len(jwtResp.Bundles) != 0 {
+			t.Errorf("JWT bundles for %v, want none", slices.Collect(maps.Keys(jwtResp.Bundles)))
+		}
+	})
+
+	t.Run("required", func(t *testing.T) {
+		shim, _ := startTestServer(t, Config{Files: tf.clone(), RequireBundlesFile: true})
+		if err := shim.Validate(); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Validate = %v, want an error for the missing trust_bundles.json", err)
+		}
+	})
+}
+
+func TestPublicKeyAsPrivateKeyFile(t *testing.T) {
+	key := newECKey(t)
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := newRSAKey(t)
+	for _, tc := range []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"pem", pemBlock("PUBLIC KEY", pub), "key.pem holds a public key, not a private key"},
+		{"pem rsa", pemBlock("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)), "key.pem holds a public key, not a private key"},
+		{"der", pub, "key.pem holds a DER public key, not a private key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shim, _ := startTestServer(t, Config{Files: map[string][]byte{"key.pem": tc.file}})
+			_, err := shim.loadPrivateKeyPKCS8DER("key.pem")
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestStripChainRoot(t *testing.T) {
+	tf := newTestFiles(t)
+	inter := tf.ca.intermediate(t)
+	leaf, key := inter.issue(t, testSPIFFEID)
+	other := newTestCA(t)
+	for _, tc := range []struct {
+		name       string
+		strip      bool
+		ca         []byte
+		wantChain  []byte
+		wantBundle []byte
+	}{
+		{"off", false, tf.ca.pem, chainOf(t, leaf, inter.pem, tf.ca.pem), tf.ca.cert.Raw},
+		{"root among the CAs", true, tf.ca.pem, chainOf(t, leaf, inter.pem), tf.ca.cert.Raw},
+		{"root added to the bundle", true, other.pem, chainOf(t, leaf, inter.pem), chainOf(t, other.pem, tf.ca.pem)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := tf.clone()
+			files["certificates.pem"] = slices.Concat(leaf, inter.pem, tf.ca.pem)
+			files["private_key.pem"], files["ca_certificates.pem"] = key, tc.ca
+			_, client := startTestServer(t, Config{Files: files, StripChainRoot: tc.strip})
+			svid := fetchX509SVID(t, client).Svids[0]
+			if !bytes.Equal(svid.X509Svid, tc.wantChain) {
+				t.Error("SVID chain is not the expected one")
+			}
+			if !bytes.Equal(svid.Bundle, tc.wantBundle) {
+				t.Error("SVID bundle is not the expected one")
+			}
+		})
+	}
+}
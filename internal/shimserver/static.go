@@ -0,0 +1,89 @@
+package shimserver
+
+import (
+	"bytes"
+	"path/filepath"
+	"time"
+)
+
+// staticFile is one credential file given directly in the Config: a path, or
+// inline PEM data when path is empty.
+type staticFile struct {
+	path string
+	data []byte
+}
+
+// staticSource serves the leaf certificate chain, private key and local CA
+// certificates configured with Config.StaticCert, StaticKey and StaticBundle
+// instead of reading them from the credentials directories. A file given by
+// path is served under that path, so errors name it; inline data is served
+// under a descriptive name. Every other file is read from the wrapped source.
+type staticSource struct {
+	credSource
+	files       map[string]staticFile
+	readTimeout time.Duration
+}
+
+// isInlinePEM reports whether a Static* value is PEM data rather than a path.
+func isInlinePEM(value string) bool {
+	return bytes.HasPrefix(bytes.TrimSpace([]byte(value)), []byte("-----BEGIN "))
+}
+
+// addStatic registers value, a path or inline PEM, as a static file and
+// returns the name it is served under. label describes the file in the name
+// of inline data.
+func (s *staticSource) addStatic(value, label string) string {
+	if isInlinePEM(value) {
+		name := "(inline " + label + ")"
+		s.files[name] = staticFile{data: []byte(value)}
+		return name
+	}
+	path := filepath.Clean(value)
+	s.files[path] = staticFile{path: path}
+	return path
+}
+
+// paths returns the paths of the static files given by path, for the watcher.
+func (s *staticSource) paths() []string {
+	var paths []string
+	for _, f := range s.files {
+		if f.path != "" {
+			paths = append(paths, f.path)
+		}
+	}
+	return paths
+}
+
+func (s *staticSource) read(name string) ([]byte, error) {
+	f, ok := s.files[name]
+	if !ok {
+		return s.credSource.read(name)
+	}
+	if f.path == "" {
+		return f.data, nil
+	}
+	return readFileTimeout(f.path, s.readTimeout)
+}
+
+func (s *staticSource) readAll(name string) ([]credFile, error) {
+	if _, ok := s.files[name]; !ok {
+		return s.credSource.readAll(name)
+	}
+	data, err := s.read(name)
+	if err != nil {
+		return nil, err
+	}
+	return []credFile{{path: name, data: data}}, nil
+}
+
+func (s *staticSource) exists(name string) bool {
+	f, ok := s.files[name]
+	if !ok {
+		return s.credSource.exists(name)
+	}
+	if f.path == "" {
+		return true
+	}
+	_, err := statTimeout(f.path, s.readTimeout)
+	return err == nil
+}
@@ -0,0 +1,50 @@
+package shimserver
+
+import "time"
+
+// Status is a snapshot of the server's effective configuration and of the
+// outcome of the last credential rebuild, for operators and tooling.
+type Status struct {
+	CredsDirs           []string  `json:"creds_dirs,omitempty"`
+	InMemory            bool      `json:"in_memory,omitempty"`
+	WatchMode           string    `json:"watch_mode"`
+	Debounce            string    `json:"debounce"`
+	MinRotationInterval string    `json:"min_rotation_interval"`
+	Identities          int       `json:"identities"`
+	Healthy             bool      `json:"healthy"`
+	Draining            bool      `json:"draining,omitempty"`
+	LastRebuild         time.Time `json:"last_rebuild"`
+	LastRebuildError    string    `json:"last_rebuild_error,omitempty"`
+}
+
+// rebuildStatus records the time and result of a rebuild.
+type rebuildStatus struct {
+	at  time.Time
+	err error
+}
+
+// Status returns the server's current Status.
+func (s *ShimServer) Status() Status {
+	st := Status{
+		CredsDirs:           s.credsDirs,
+		WatchMode:           s.watchMode,
+		Debounce:            s.settings.Load().debounce.String(),
+		MinRotationInterval: s.minRotationInterval.String(),
+		Healthy:             !s.degraded.Load(),
+		Draining:            s.draining.Load(),
+	}
+	if _, ok := s.baseSource().(*memSource); ok {
+		st.InMemory = true
+		st.WatchMode = "none"
+	}
+	if resp := s.x509SVID.Load(); resp != nil {
+		st.Identities = len(resp.Svids)
+	}
+	if last := s.lastRebuild.Load(); last != nil {
+		st.LastRebuild = last.at
+		if last.err != nil {
+			st.LastRebuildError = last.err.Error()
+		}
+	}
+	return st
+}
@@ -0,0 +1,60 @@
+package shimserver
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// LogSummary logs the identities and trust domains the shim is about to serve,
+// so operators can confirm at startup that the mounted credentials are the
+// expected ones. Failures are logged rather than returned: Validate has already
+// checked the files, and serving continues with the last good responses.
+func (s *ShimServer) LogSummary() {
+	svidResp, err := s.buildX509SVIDResponse()
+	if err != nil {
+		slog.Warn("startup summary: build X.509 SVID response failed", "error", err)
+		return
+	}
+	for _, svid := range svidResp.Svids {
+		args := []any{"spiffe_id", svid.SpiffeId}
+		if leaf, err := x509.ParseCertificate(svid.X509Svid); err == nil {
+			args = append(args, "not_after", leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+		if svid.Hint != "" {
+			args = append(args, "hint", svid.Hint)
+		}
+		slog.Info("loaded identity", args...)
+	}
+
+	cas, err := s.loadCABundle()
+	if err != nil {
+		slog.Warn("startup summary: load CA certificates failed", "error", err)
+		return
+	}
+	tb, err := s.loadTrustBundles()
+	if err != nil {
+		slog.Warn("startup summary: load trust bundles failed", "error", err)
+		return
+	}
+	var localTD string
+	if id, err := spiffeid.FromString(svidResp.Svids[0].SpiffeId); err == nil {
+		localTD = id.TrustDomain().Name()
+	}
+	slog.Info("loaded local trust domain", "trust_domain", localTD, "ca_certificates", len(cas))
+
+	domains := make([]string, 0, len(tb.TrustDomains))
+	for domain := range tb.TrustDomains {
+		if domain != localTD {
+			domains = append(domains, domain)
+		}
+	}
+	slices.Sort(domains)
+	for _, domain := range domains {
+		slog.Info("loaded federated trust domain", "trust_domain", domain,
+			"spiffe_sequence", tb.TrustDomains[domain].SpiffeSequence)
+	}
+}
@@ -0,0 +1,33 @@
+package shimserver
+
+import (
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the rebuild and rotation spans. It uses the global tracer
+// provider, so spans are only exported once the embedder installs one, and
+// cost nothing otherwise.
+var tracer = otel.Tracer("github.com/larkintuckerllc/workload-api-shim/internal/shimserver")
+
+// endRebuildSpan records the served identities and the outcome of a rebuild
+// on span and ends it.
+func (s *ShimServer) endRebuildSpan(span trace.Span, err error) {
+	if resp := s.x509SVID.Load(); resp != nil {
+		ids := svidIDs(resp)
+		span.SetAttributes(attribute.StringSlice("spiffe_ids", ids))
+		if len(ids) > 0 {
+			if id, perr := spiffeid.FromString(ids[0]); perr == nil {
+				span.SetAttributes(attribute.String("trust_domain", id.TrustDomain().Name()))
+			}
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,313 @@
+package shimserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// isCredentialFile reports whether name, a base name within credsDirs, is a file
+// the shim reads or the ..data symlink Kubernetes swaps on rotation. Events on
+// other files, such as editor temp files or lock files, are ignored.
+func (s *ShimServer) isCredentialFile(name string) bool {
+	switch name {
+	case s.certFile, s.keyFile, s.caFile, s.bundlesFile, s.intermediatesFile, "hints.json", jwtSigningKeyFile, "..data":
+		return true
+	}
+	if s.sdsFile != "" && name == s.sdsFile {
+		return true
+	}
+	if s.p12File != "" && (name == s.p12File || isNumberedFile(name, s.p12File)) {
+		return true
+	}
+	return isNumberedFile(name, s.certFile) || isNumberedFile(name, s.keyFile)
+}
+
+// watchedFiles returns the paths of the credential files that exist in any of
+// credsDirs, of the static credential files and of the lock file.
+func (s *ShimServer) watchedFiles() []string {
+	names := []string{s.caFile, s.bundlesFile, s.intermediatesFile, "hints.json", jwtSigningKeyFile}
+	if s.sdsFile != "" {
+		names = append(names, s.sdsFile)
+	}
+	for _, set := range s.credentialSets() {
+		names = append(names, set.certSource())
+		if set.keySource() != set.certSource() {
+			names = append(names, set.keySource())
+		}
+	}
+	paths := append(slices.Clone(s.staticPaths), s.existingLockPaths()...)
+	for _, dir := range s.credsDirs {
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			if _, err := statTimeout(path, s.readTimeout); err == nil {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// addFileWatches watches each existing credential file by path. Watches are
+// dropped by the kernel when a file is renamed or removed, so this is called
+// again after every rotation to pick up the replacement files.
+func (s *ShimServer) addFileWatches(w *fsnotify.Watcher) {
+	for _, path := range s.watchedFiles() {
+		if err := w.Add(path); err != nil {
+			slog.Error("credential watcher: add watch failed", "path", path, "error", err)
+		}
+	}
+}
+
+// startWatcher watches credsDirs for file changes and broadcasts to active streams.
+// Changes are debounced by the Debounce setting to coalesce rapid multi-file rotation events.
+//
+// Rename and Remove events count as changes so that Kubernetes secret and
+// projected volume mounts are picked up: the kubelet rotates those by renaming
+// a new ..data symlink into place, so the visible files never see a Write.
+//
+// With watchFiles set, the credential files are watched by path instead of
+// watching the whole directories.
+//
+// The parent of each credentials directory is watched too, so that replacing
+// the directory itself, including repointing a symlink to a new directory,
+// is noticed: the watch is then moved to the new directory and the
+// credentials are rebuilt.
+//
+// While the lock file exists no rotation runs; its removal is a change like
+// any other, so the rotation the writer held back runs once it is gone.
+//
+// Rotations are at least minRotationInterval apart. A change debounced during
+// the cooldown marks a rotation pending, which runs once when it ends.
+//
+// The returned error matches errors.ErrUnsupported when the filesystem does
+// not support inotify, so the caller can fall back to startPoller.
+func (s *ShimServer) startWatcher() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watched := make(map[string]os.FileInfo, len(s.credsDirs))
+	parents := make(map[string]bool)
+	for _, dir := range s.credsDirs {
+		fi, err := statTimeout(dir, s.readTimeout)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		watched[filepath.Clean(dir)] = fi
+		if parent := filepath.Dir(filepath.Clean(dir)); !parents[parent] {
+			parents[parent] = true
+			if err := w.Add(parent); err != nil {
+				slog.Warn("credential watcher: cannot watch parent directory, replacing the credentials directory will not be detected",
+					"path", parent, "error", err)
+			}
+		}
+		if s.watchFiles {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	// Static credential files are watched through their directories, like the
+	// credentials directories, unless watched by path.
+	if !s.watchFiles {
+		for _, path := range s.staticPaths {
+			if err := w.Add(filepath.Dir(path)); err != nil {
+				w.Close()
+				return err
+			}
+		}
+		for _, path := range s.lockPaths {
+			if _, inDir := watched[filepath.Dir(path)]; inDir {
+				continue
+			}
+			if err := w.Add(filepath.Dir(path)); err != nil {
+				w.Close()
+				return err
+			}
+		}
+	}
+	if s.watchFiles {
+		for _, path := range s.watchedFiles() {
+			if err := w.Add(path); errors.Is(err, errors.ErrUnsupported) {
+				w.Close()
+				return err
+			} else if err != nil {
+				slog.Error("credential watcher: add watch failed", "path", path, "error", err)
+			}
+		}
+	}
+	go func() {
+		defer w.Close()
+		debounce := time.NewTimer(s.settings.Load().debounce)
+		debounce.Stop()
+		defer debounce.Stop()
+		cooldown := time.NewTimer(s.minRotationInterval)
+		cooldown.Stop()
+		defer cooldown.Stop()
+		var lastRotation time.Time
+		pending := false
+		for {
+			select {
+			case <-s.done:
+				return
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// Events on the directories themselves are kept so replacement is
+				// detected; other events must name a credential file in one of them.
+				name := filepath.Clean(event.Name)
+				if _, isDir := watched[name]; !isDir && !slices.Contains(s.staticPaths, name) && !slices.Contains(s.lockPaths, name) {
+					if _, inDir := watched[filepath.Dir(name)]; !inDir || !s.isCredentialFile(filepath.Base(name)) {
+						continue
+					}
+				}
+				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) ||
+					event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+					debounce.Reset(s.settings.Load().debounce)
+				}
+			case <-debounce.C:
+				if s.watchFiles {
+					s.addFileWatches(w)
+				} else {
+					for dir, fi := range watched {
+						watched[dir] = s.rewatchIfReplaced(w, dir, fi)
+					}
+				}
+				if pending {
+					continue
+				}
+				if lock := s.lockedBy(); lock != "" {
+					slog.Info("credential watcher: lock file present, deferring rotation", "path", lock)
+					continue
+				}
+				if wait := s.minRotationInterval - time.Since(lastRotation); wait > 0 {
+					slog.Debug("credential watcher: delaying rotation", "wait", wait)
+					pending = true
+					cooldown.Reset(wait)
+					continue
+				}
+				s.rotateIfChanged()
+				lastRotation = time.Now()
+			case <-cooldown.C:
+				pending = false
+				if lock := s.lockedBy(); lock != "" {
+					slog.Info("credential watcher: lock file present, deferring rotation", "path", lock)
+					continue
+				}
+				s.rotateIfChanged()
+				lastRotation = time.Now()
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("credential watcher error", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// rotate rebuilds the cached responses, retrying on failure, and signals the
+// open streams of every response that changed to send the result. Concurrent
+// calls are coalesced: a call made while a rotation is running only marks it
+// dirty, and the running call then rebuilds once more, so a burst of
+// triggers costs at most two rebuilds.
+func (s *ShimServer) rotate() {
+	s.rotateMu.Lock()
+	if s.rotating {
+		s.rotateDirty = true
+		s.rotateMu.Unlock()
+		return
+	}
+	s.rotating = true
+	s.rotateMu.Unlock()
+	for {
+		s.rebuildAndBroadcast()
+		s.rotateMu.Lock()
+		if !s.rotateDirty {
+			s.rotating = false
+			s.rotateMu.Unlock()
+			return
+		}
+		s.rotateDirty = false
+		s.rotateMu.Unlock()
+	}
+}
+
+func (s *ShimServer) rebuildAndBroadcast() {
+	ctx, span := tracer.Start(context.Background(), "rotation")
+	defer span.End()
+	err := s.withRetry(rebuildBackoff, func() error { return s.rebuildTraced(ctx) })
+	if err != nil {
+		rebuildRetriesExhaustedTotal.Inc()
+		slog.Warn("credential rebuild failed after retries, serving last-good responses",
+			"attempts", len(rebuildBackoff)+1, "error", err)
+	}
+	s.degraded.Store(err != nil)
+	s.setHealth(err == nil)
+	rotationsTotal.Inc()
+	topics := s.publish()
+	span.AddEvent("broadcast", trace.WithAttributes(attribute.StringSlice("topics", topics)))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	slog.Info("credentials rotated, pushing update to connected streams", "topics", topics)
+	if err == nil {
+		s.writeOut()
+		s.notify()
+	}
+}
+
+// publish signals the streams of every cached response that changed since the
+// last publish and returns the topics that were signalled.
+func (s *ShimServer) publish() []string {
+	var changed []string
+	for _, p := range []struct {
+		topic string
+		v     any
+	}{
+		{topicX509SVID, s.x509SVID.Load()},
+		{topicX509Bundles, s.x509Bundles.Load()},
+		{topicJWTBundles, s.jwtBundles.Load()},
+	} {
+		if s.bcast.publish(p.topic, p.v) {
+			changed = append(changed, p.topic)
+		}
+	}
+	return changed
+}
+
+// rewatchIfReplaced re-adds the watch on dir when the path now refers to a
+// different inode than the one being watched, which happens when the directory
+// itself is removed and recreated. It returns the file info now being watched.
+func (s *ShimServer) rewatchIfReplaced(w *fsnotify.Watcher, dir string, watched os.FileInfo) os.FileInfo {
+	current, err := statTimeout(dir, s.readTimeout)
+	if err != nil {
+		slog.Error("credential watcher: stat failed", "path", dir, "error", err)
+		return watched
+	}
+	if os.SameFile(watched, current) {
+		return watched
+	}
+	w.Remove(dir) // the kernel has usually dropped the stale watch already
+	if err := w.Add(dir); err != nil {
+		slog.Error("credential watcher: re-add watch failed", "path", dir, "error", err)
+		return watched
+	}
+	slog.Info("credential watcher: directory was replaced, re-added watch", "path", dir)
+	return current
+}
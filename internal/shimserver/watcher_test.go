@@ -0,0 +1,199 @@
+package shimserver
+
+import (
+	"bytes"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+)
+
+// writeDir writes files into a new directory dir.
+func writeDir(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// nextLeaf waits for the next X509-SVID response and fails unless its leaf is
+// certPEM.
+func nextLeaf(t *testing.T, r *receiver[*workloadv1.X509SVIDResponse], certPEM []byte) {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if !bytes.HasPrefix(r.next(t).Svids[0].X509Svid, block.Bytes) {
+		t.Fatal("SVID is not the one last written")
+	}
+}
+
+func TestWatcherFollowsReplacedDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		create  func(t *testing.T, dir string, files map[string][]byte)
+		replace func(t *testing.T, dir string, files map[string][]byte)
+	}{
+		{
+			name:   "renamed",
+			create: writeDir,
+			replace: func(t *testing.T, dir string, files map[string][]byte) {
+				if err := os.Rename(dir, dir+".old"); err != nil {
+					t.Fatal(err)
+				}
+				writeDir(t, dir, files)
+			},
+		},
+		{
+			name: "symlink repointed",
+			create: func(t *testing.T, dir string, files map[string][]byte) {
+				writeDir(t, dir+".v1", files)
+				if err := os.Symlink(dir+".v1", dir); err != nil {
+					t.Fatal(err)
+				}
+			},
+			replace: func(t *testing.T, dir string, files map[string][]byte) {
+				writeDir(t, dir+".v2", files)
+				if err := os.Symlink(dir+".v2", dir+".tmp"); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(dir+".tmp", dir); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf := newTestFiles(t)
+			dir := filepath.Join(t.TempDir(), "creds")
+			tc.create(t, dir, tf.files)
+			_, client := startTestServer(t, Config{CredsDirs: []string{dir}, Debounce: 20 * time.Millisecond})
+			stream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := receive(stream.Recv)
+			r.next(t)
+
+			tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, testSPIFFEID)
+			tc.replace(t, dir, tf.files)
+			nextLeaf(t, r, tf.files["certificates.pem"])
+
+			// Writes to the new directory are still seen.
+			cert, key := tf.ca.issue(t, testSPIFFEID)
+			if err := os.WriteFile(filepath.Join(dir, "private_key.pem"), key, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "certificates.pem"), cert, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			nextLeaf(t, r, cert)
+		})
+	}
+}
+
+// atomicWrite rotates dir the way the kubelet's atomic writer does: it writes
+// files into the new timestamped directory ts, points ..data_tmp at it and
+// renames ..data_tmp over ..data, then removes the previous directory, if
+// any. The visible files are symlinks through ..data, created on the first
+// write.
+func atomicWrite(t *testing.T, dir, ts, prev string, files map[string][]byte) {
+	t.Helper()
+	writeDir(t, filepath.Join(dir, ts), files)
+	if err := os.Symlink(ts, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if prev == "" {
+		for name := range files {
+			if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(dir, prev)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherFollowsKubernetesAtomicWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		watchFiles bool
+	}{
+		{"directory watch", false},
+		{"file watch", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf := newTestFiles(t)
+			dir := t.TempDir()
+			atomicWrite(t, dir, "..2026_x", "", tf.files)
+			_, client := startTestServer(t, Config{
+				CredsDirs:  []string{dir},
+				Debounce:   20 * time.Millisecond,
+				WatchFiles: tc.watchFiles,
+			})
+			stream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := receive(stream.Recv)
+			r.next(t)
+
+			tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, testSPIFFEID)
+			atomicWrite(t, dir, "..2026_y", "..2026_x", tf.files)
+			nextLeaf(t, r, tf.files["certificates.pem"])
+
+			// The files behind the new ..data are watched too.
+			tf.files["certificates.pem"], tf.files["private_key.pem"] = tf.ca.issue(t, testSPIFFEID)
+			atomicWrite(t, dir, "..2026_z", "..2026_y", tf.files)
+			nextLeaf(t, r, tf.files["certificates.pem"])
+		})
+	}
+}
+
+func TestUnchangedFilesAreNotRotated(t *testing.T) {
+	tf := newTestFiles(t)
+	dir := filepath.Join(t.TempDir(), "creds")
+	writeDir(t, dir, tf.files)
+	_, client := startTestServer(t, Config{CredsDirs: []string{dir}, Debounce: 20 * time.Millisecond})
+	stream, err := client.FetchX509SVID(streamCtx(t), &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := receive(stream.Recv)
+	r.next(t)
+	before := testutil.ToFloat64(rotationsTotal)
+
+	// A touch and a rewrite with the same content are both skipped.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "certificates.pem"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "private_key.pem"), tf.files["private_key.pem"], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r.none(t, 300*time.Millisecond)
+	if n := testutil.ToFloat64(rotationsTotal) - before; n != 0 {
+		t.Fatalf("%v rotations for unchanged files, want 0", n)
+	}
+
+	cert, key := tf.ca.issue(t, testSPIFFEID)
+	if err := os.WriteFile(filepath.Join(dir, "private_key.pem"), key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "certificates.pem"), cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	nextLeaf(t, r, cert)
+}
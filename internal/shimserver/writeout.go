@@ -0,0 +1,112 @@
+package shimserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// The basenames written to Config.WriteDir, matching the defaults of
+// spiffe-helper so that consumers configured for it need no changes.
+const (
+	writeCertFile   = "svid.pem"
+	writeKeyFile    = "svid_key.pem"
+	writeBundleFile = "svid_bundle.pem"
+)
+
+// writeFiles writes the served default SVID to writeDir as PEM: its leaf and
+// chain, its private key and the local trust bundle. Each file is replaced
+// atomically, so a consumer never reads a partially written file, and files
+// whose content did not change are left untouched. The bundle is written
+// first and the certificate last, so a consumer reloading when the
+// certificate changes finds the matching key and bundle in place.
+func (s *ShimServer) writeFiles() error {
+	resp := s.x509SVID.Load()
+	if resp == nil || len(resp.Svids) == 0 {
+		return errors.New("no X.509 SVID to write")
+	}
+	svid := resp.Svids[0]
+	certs, err := x509.ParseCertificates(svid.X509Svid)
+	if err != nil {
+		return fmt.Errorf("parse SVID: %w", err)
+	}
+	cas, err := x509.ParseCertificates(svid.Bundle)
+	if err != nil {
+		return fmt.Errorf("parse bundle: %w", err)
+	}
+	if err := os.MkdirAll(s.writeDir, 0o755); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm fs.FileMode
+	}{
+		{writeBundleFile, encodeCertsPEM(cas), 0o644},
+		{writeKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: svid.X509SvidKey}), 0o600},
+		{writeCertFile, encodeCertsPEM(certs), 0o644},
+	}
+	for _, f := range files {
+		if err := writeFileAtomic(filepath.Join(s.writeDir, f.name), f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeCertsPEM(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// writeFileAtomic replaces path with data by writing a temporary file in the
+// same directory and renaming it over path. It does nothing when path already
+// holds data.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	if cur, err := os.ReadFile(path); err == nil && bytes.Equal(cur, data) {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeOut calls writeFiles when a write directory is configured, logging
+// the outcome. A failed write does not affect the served responses.
+func (s *ShimServer) writeOut() {
+	if s.writeDir == "" {
+		return
+	}
+	if err := s.writeFiles(); err != nil {
+		slog.Warn("write credential files failed", "write_dir", s.writeDir, "error", err)
+		return
+	}
+	slog.Debug("wrote credential files", "write_dir", s.writeDir)
+}
@@ -0,0 +1,160 @@
+package shimtest_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/larkintuckerllc/workload-api-shim/internal/shimserver"
+	"github.com/larkintuckerllc/workload-api-shim/shimtest"
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func ExampleDial() {
+	client, err := shimtest.Dial("/tmp/spiffe-workload-api.sock")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(resp.Svids[0].SpiffeId)
+}
+
+const testSPIFFEID = "spiffe://example.org/workload"
+
+// testCredentials returns the credential files of a ShimServer serving a leaf
+// for testSPIFFEID issued by a new self-signed CA.
+func testCredentials(t *testing.T) map[string][]byte {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := url.Parse(testSPIFFEID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		URIs:         []*url.URL{id},
+	}, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"certificates.pem":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		"private_key.pem":     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		"ca_certificates.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		"trust_bundles.json":  []byte(`{"trust_domains": {}}`),
+	}
+}
+
+// requireWorkloadHeader rejects streams without shimtest.WorkloadHeader, as
+// the shim does by default.
+func requireWorkloadHeader(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	if len(md.Get(shimtest.WorkloadHeader)) == 0 {
+		return status.Errorf(codes.InvalidArgument, "missing required header: %s", shimtest.WorkloadHeader)
+	}
+	return handler(srv, ss)
+}
+
+func TestDialFetchX509SVID(t *testing.T) {
+	shim, err := shimserver.New(shimserver.Config{Files: testCredentials(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shim.Close()
+
+	// A short directory keeps the socket path within the unix socket limit.
+	dir, err := os.MkdirTemp("", "shimtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "workload.sock")
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.StreamInterceptor(requireWorkloadHeader))
+	workloadv1.RegisterSpiffeWorkloadAPIServer(srv, shim)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	client, err := shimtest.Dial(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Svids) != 1 || resp.Svids[0].SpiffeId != testSPIFFEID {
+		t.Fatalf("FetchX509SVID returned %v, want one SVID for %s", resp.Svids, testSPIFFEID)
+	}
+}
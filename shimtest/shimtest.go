@@ -0,0 +1,85 @@
+// Package shimtest helps integration tests talk to a running workload-api-shim.
+//
+// Dial returns a Workload API client that already sends the workload.spiffe.io
+// metadata header the shim requires, so a FetchX509SVID round-trip is:
+//
+//	client, err := shimtest.Dial("/tmp/spiffe-workload-api.sock")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer client.Close()
+//
+//	stream, err := client.FetchX509SVID(ctx, &workloadv1.X509SVIDRequest{})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	resp, err := stream.Recv()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	t.Log(resp.Svids[0].SpiffeId)
+package shimtest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	workloadv1 "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// WorkloadHeader is the metadata header the SPIFFE Workload Endpoint spec
+// requires on every call, and that the shim enforces by default.
+const WorkloadHeader = "workload.spiffe.io"
+
+// Client is a Workload API client connected to a shim. Close releases the
+// underlying connection.
+type Client struct {
+	workloadv1.SpiffeWorkloadAPIClient
+	conn *grpc.ClientConn
+}
+
+// Dial connects to the shim listening on the unix socket at socketPath. A path
+// starting with "@" names a Linux abstract socket, as with --socket-path.
+// Every call made through the returned client carries WorkloadHeader.
+func Dial(socketPath string) (*Client, error) {
+	target := "unix://" + socketPath
+	if abstract, ok := strings.CutPrefix(socketPath, "@"); ok {
+		target = "unix-abstract:" + abstract
+	}
+	return DialTarget(target)
+}
+
+// DialTarget is like Dial for an arbitrary gRPC target, such as
+// "dns:///127.0.0.1:8081" for a shim started with --listen-network tcp.
+func DialTarget(target string) (*Client, error) {
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(workloadHeaderUnary),
+		grpc.WithStreamInterceptor(workloadHeaderStream),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create client for %s: %w", target, err)
+	}
+	return &Client{SpiffeWorkloadAPIClient: workloadv1.NewSpiffeWorkloadAPIClient(conn), conn: conn}, nil
+}
+
+// Close closes the connection to the shim.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func withWorkloadHeader(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, WorkloadHeader, "true")
+}
+
+func workloadHeaderUnary(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withWorkloadHeader(ctx), method, req, reply, cc, opts...)
+}
+
+func workloadHeaderStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withWorkloadHeader(ctx), desc, cc, method, opts...)
+}